@@ -0,0 +1,65 @@
+package gosang
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/pkg/errors"
+)
+
+// Convert creates new sprite of given kind which has the same frames as sp.
+// Background pixels are mapped between kinds: index 0xfe of 8-bit sprites,
+// the color key of 32-bit sprites w/o alpha channel and pixels whose alpha is
+// below the alpha threshold of 32-bit sprites w/ alpha channel. ColorKey,
+// AlphaThreshold and Palette options can be given to change the mapping.
+func Convert(sp Sprite, kind Kind, opts ...Option) (Sprite, error) {
+	o := newOptions(opts)
+	from := sp.Kind()
+	frames := make([]image.Image, sp.FrameCount())
+	for i := range frames {
+		fr, err := sp.Frame(i)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get frame #%d", i)
+		}
+		frames[i] = convertImage(fr.Image(), from, kind, o)
+	}
+	return NewSprite(kind, sp.FrameWidth(), sp.FrameHeight(), frames, opts...)
+}
+
+func convertImage(img image.Image, from, to Kind, o *options) image.Image {
+	if from == to {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, a := rgbaAt(img, b.Min.X+x, b.Min.Y+y)
+			bg := false
+			switch from {
+			case Kind8:
+				if p, ok := img.(*image.Paletted); ok {
+					bg = p.ColorIndexAt(b.Min.X+x, b.Min.Y+y) == 0xfe
+				} else {
+					bg = a == 0
+				}
+			case Kind32:
+				bg = r == o.colorKey.R && g == o.colorKey.G && bl == o.colorKey.B
+			case Kind32Alpha:
+				bg = a < o.alphaThreshold
+			}
+			switch {
+			case !bg:
+				dst.SetNRGBA(x, y, color.NRGBA{r, g, bl, 0xff})
+			case to == Kind32:
+				dst.SetNRGBA(x, y, o.colorKey)
+			default:
+				dst.SetNRGBA(x, y, color.NRGBA{o.colorKey.R, o.colorKey.G, o.colorKey.B, 0})
+			}
+		}
+	}
+	if to == Kind8 {
+		return quantize(dst, o.palette8(), o.dither, 0x80)
+	}
+	return dst
+}
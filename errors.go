@@ -0,0 +1,80 @@
+package gosang
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Errors which can be inspected with errors.Is.
+var (
+	ErrBadSignature    = errors.New("bad signature")
+	ErrFrameOutOfRange = errors.New("frame index out of range")
+	ErrTruncated       = errors.New("sprite data is truncated")
+	ErrRowOverflow     = errors.New("pixel run overflows frame row")
+)
+
+// FormatError describes where malformed sprite data has been found. Fields
+// which are unknown or don't apply are -1, or 0 for Kind.
+type FormatError struct {
+	Kind   Kind  // Kind of the sprite.
+	Frame  int   // Index of the frame being decoded.
+	Row    int   // Row in the frame, in pixels.
+	Column int   // Column in the frame, in pixels.
+	Offset int64 // Offset in sprite data.
+	Err    error // Underlying error, such as ErrTruncated.
+}
+
+func (e *FormatError) Error() string {
+	var ss []string
+	if e.Kind != 0 {
+		ss = append(ss, e.Kind.String()+" sprite")
+	}
+	if e.Frame >= 0 {
+		ss = append(ss, fmt.Sprintf("frame #%d", e.Frame))
+	}
+	if e.Row >= 0 && e.Column >= 0 {
+		ss = append(ss, fmt.Sprintf("row %d, column %d", e.Row, e.Column))
+	}
+	if e.Offset >= 0 {
+		ss = append(ss, fmt.Sprintf("offset %#x", e.Offset))
+	}
+	ss = append(ss, e.Err.Error())
+	return strings.Join(ss, ": ")
+}
+
+// Unwrap returns the underlying error.
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// newFormatError creates new FormatError which is not specific to a frame.
+// Unexpected EOF errors are reported as ErrTruncated.
+func newFormatError(kind Kind, row, col int, offset int64, err error) *FormatError {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return &FormatError{kind, -1, row, col, offset, err}
+}
+
+// locateError fills frame index in err if it's a FormatError, and makes its
+// offset relative to sprite data from relative to frame data which starts at
+// base.
+func locateError(err error, frame int, base int64) error {
+	var fe *FormatError
+	if errors.As(err, &fe) && fe.Frame < 0 {
+		fe.Frame = frame
+		fe.Offset += base
+	}
+	return err
+}
+
+// readField reads little endian encoded data at offset from r.
+func readField(r io.ReaderAt, kind Kind, offset int64, data interface{}) error {
+	if err := binary.Read(&offsetedReader{r, offset}, binary.LittleEndian, data); err != nil {
+		return newFormatError(kind, -1, -1, offset, err)
+	}
+	return nil
+}
@@ -11,14 +11,18 @@ type Frame struct {
 	width  int
 	height int
 	img    image.Image
+	raw    []byte // Encoded data of frame w/o backing data, if any.
 }
 
 func newFrame(sp Sprite, idx int, img image.Image) *Frame {
-	return &Frame{sp, idx, sp.FrameWidth(), sp.FrameHeight(), img}
+	return &Frame{sp, idx, sp.FrameWidth(), sp.FrameHeight(), img, nil}
 }
 
 // Index returns frame's index in sprite.
 func (fr *Frame) Index() int {
+	mu := &fr.sp.base().mu
+	mu.RLock()
+	defer mu.RUnlock()
 	return fr.idx
 }
 
@@ -0,0 +1,101 @@
+//go:build go1.18
+// +build go1.18
+
+package gosang
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzMaxPixels keeps fuzzing from spending its time on huge frames.
+const fuzzMaxPixels = 1 << 20
+
+// addFuzzSeeds adds test sprites as seed corpus. WindCutter.S32 is left out,
+// since mutating megabytes of input makes fuzzing crawl.
+func addFuzzSeeds(f *testing.F) {
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32"} {
+		data, err := ioutil.ReadFile(filepath.Join("test", "data", name))
+		if err != nil {
+			f.Fatalf("sprite %q: failed to read file: %v", name, err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzOpenSprite(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, opts := range [][]Option{{}, {Lazy()}, {Strict()}} {
+			sp, err := OpenSprite(bytes.NewReader(data), append(opts, MaxPixels(fuzzMaxPixels))...)
+			if err != nil {
+				continue
+			}
+			for i := 0; i < sp.FrameCount(); i++ {
+				sp.Frame(i)
+				sp.RawFrame(i)
+			}
+			sp.Frame(-1)
+			sp.Frame(sp.FrameCount())
+			sp.Save(ioutil.Discard)
+		}
+		Validate(bytes.NewReader(data))
+		if sp, _, err := Salvage(bytes.NewReader(data), MaxPixels(fuzzMaxPixels)); err == nil {
+			sp.Save(ioutil.Discard)
+		}
+		DecodeSprite(bytes.NewReader(data), MaxPixels(fuzzMaxPixels))
+	})
+}
+
+func FuzzSaveRoundTrip(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sp, err := OpenSprite(bytes.NewReader(data), MaxPixels(fuzzMaxPixels))
+		if err != nil {
+			return
+		}
+		buf := new(bytes.Buffer)
+		if err := sp.Save(buf); err != nil {
+			return
+		}
+		sp2, err := OpenSprite(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("failed to reopen saved sprite: %v", err)
+		}
+		if sp2.Kind() != sp.Kind() || sp2.FrameCount() != sp.FrameCount() {
+			t.Fatalf("mismatched sprite; expected %v with %d frames, got %v with %d frames", sp.Kind(), sp.FrameCount(), sp2.Kind(), sp2.FrameCount())
+		}
+		for i := 0; i < sp.FrameCount(); i++ {
+			fr, _ := sp.Frame(i)
+			fr2, err := sp2.Frame(i)
+			if err != nil {
+				t.Fatalf("failed to get frame #%d: %v", i, err)
+			}
+			if !sameImage(fr.Image(), fr2.Image()) {
+				t.Fatalf("frame #%d differs after round trip", i)
+			}
+		}
+	})
+}
+
+// sameImage reports whether a and b have the same bounds and premultiplied
+// colors. Fully transparent pixels are equal regardless of their color.
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ar, ag, ab, aa := a.At(x, y).RGBA()
+			br, bg, bb, ba := b.At(x, y).RGBA()
+			if ar != br || ag != bg || ab != bb || aa != ba {
+				return false
+			}
+		}
+	}
+	return true
+}
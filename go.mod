@@ -0,0 +1,5 @@
+module github.com/hallazzang/gosang
+
+go 1.13
+
+require github.com/pkg/errors v0.9.1
@@ -0,0 +1,181 @@
+package gosang
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Kind is a kind of sprite format.
+type Kind int
+
+// Available sprite kinds.
+const (
+	Kind8       Kind = iota + 1 // 8-bit color sprite(.spr)
+	Kind32                      // 32-bit color sprite w/o alpha channel
+	Kind32Alpha                 // 32-bit color sprite w/ alpha channel
+)
+
+// Signatures stored in the first 4 bytes of sprite data for each kind.
+const (
+	Signature8       uint32 = 0x09
+	Signature32      uint32 = 0x0f
+	Signature32Alpha uint32 = 0x19
+)
+
+// kindInfo describes a kind of sprite format.
+type kindInfo struct {
+	name      string
+	signature uint32
+	colorBits int
+	hasAlpha  bool
+	layout    layout
+	create    func(o *options) Sprite // Create empty sprite w/o backing data.
+}
+
+// layout describes where header tables of a kind of sprite are. Every kind
+// has 16 bytes of spriteHeader first, then the frame offset table at 0x4c0
+// which has 300 entries of 4 bytes each.
+type layout struct {
+	sizes     int64 // Offset of frame size table, which follows offset table.
+	sizeEntry int   // Size of frame size table's entries, in bytes.
+	sizeUnit  int   // Unit of frame sizes in frame size table, in bytes.
+	dataSize  int64 // Offset of total frame data size, followed by width and height.
+	data      int64 // Offset of frame data, which follows the header.
+}
+
+// sizeTable converts frame sizes in units of l.sizeUnit to frame size table
+// entries, which are written as-is.
+func (l *layout) sizeTable(sizes []uint32) interface{} {
+	if l.sizeEntry == 2 {
+		t := make([]uint16, len(sizes))
+		for i, s := range sizes {
+			t[i] = uint16(s)
+		}
+		return t
+	}
+	return sizes
+}
+
+// readSizeTable reads frame size table of n entries from r, in units of
+// l.sizeUnit.
+func (l *layout) readSizeTable(r io.ReaderAt, kind Kind, n int) ([]uint32, error) {
+	if l.sizeEntry == 2 {
+		t := make([]uint16, n)
+		if err := readField(r, kind, l.sizes, t); err != nil {
+			return nil, err
+		}
+		sizes := make([]uint32, n)
+		for i, s := range t {
+			sizes[i] = uint32(s)
+		}
+		return sizes, nil
+	}
+	sizes := make([]uint32, n)
+	if err := readField(r, kind, l.sizes, sizes); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// offsetsOffset is the offset of frame offset table of every kind.
+const offsetsOffset = 0x4c0
+
+// layout32 is the layout shared by 32-bit sprites w/ and w/o alpha channel.
+var layout32 = layout{sizes: 0x970, sizeEntry: 4, sizeUnit: 4, dataSize: 0xe20, data: 0xe4c}
+
+// kinds is the registry of all supported kinds.
+var kinds = map[Kind]*kindInfo{
+	Kind8: {
+		name:      "8-bit",
+		signature: Signature8,
+		colorBits: 8,
+		layout:    layout{sizes: 0x970, sizeEntry: 2, sizeUnit: 1, dataSize: 0xbc8, data: 0xbf4},
+		create: func(o *options) Sprite {
+			sp := &sprite8{palette: o.palette8()}
+			sp.outer = sp
+			return sp
+		},
+	},
+	Kind32: {
+		name:      "32-bit",
+		signature: Signature32,
+		colorBits: 32,
+		layout:    layout32,
+		create: func(o *options) Sprite {
+			sp := &sprite32{colorKey: o.colorKey, keyAsAlpha: o.transparency == TransparentBackground}
+			sp.outer = sp
+			return sp
+		},
+	},
+	Kind32Alpha: {
+		name:      "32-bit alpha",
+		signature: Signature32Alpha,
+		colorBits: 32,
+		hasAlpha:  true,
+		layout:    layout32,
+		create: func(o *options) Sprite {
+			sp := &sprite32Alpha{}
+			sp.outer = sp
+			return sp
+		},
+	},
+}
+
+// signatureList returns comma separated list of all known signatures.
+func signatureList() string {
+	var sigs []int
+	for _, ki := range kinds {
+		sigs = append(sigs, int(ki.signature))
+	}
+	sort.Ints(sigs)
+	ss := make([]string, len(sigs))
+	for i, sig := range sigs {
+		ss[i] = fmt.Sprintf("%#x", sig)
+	}
+	return strings.Join(ss, ", ")
+}
+
+// KindOf returns kind which has given signature. ok is false if there's no
+// such kind.
+func KindOf(signature uint32) (k Kind, ok bool) {
+	for k, ki := range kinds {
+		if ki.signature == signature {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// String returns human readable name of the kind.
+func (k Kind) String() string {
+	if ki, ok := kinds[k]; ok {
+		return ki.name
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Signature returns the signature of the kind. It returns 0 for unknown kinds.
+func (k Kind) Signature() uint32 {
+	if ki, ok := kinds[k]; ok {
+		return ki.signature
+	}
+	return 0
+}
+
+// ColorBits returns color bits of the kind. 8 or 32, or 0 for unknown kinds.
+func (k Kind) ColorBits() int {
+	if ki, ok := kinds[k]; ok {
+		return ki.colorBits
+	}
+	return 0
+}
+
+// HasAlpha tells whether sprites of the kind have alpha channel or not.
+func (k Kind) HasAlpha() bool {
+	if ki, ok := kinds[k]; ok {
+		return ki.hasAlpha
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package gosang
+
+import (
+	"image/color"
+)
+
+// Option changes how a sprite is decoded, created, converted or quantized.
+type Option func(*options)
+
+// TransparencyPolicy tells how sprite's background pixels are decoded.
+type TransparencyPolicy int
+
+// Available transparency policies.
+const (
+	KeepBackground        TransparencyPolicy = iota // Decode background as opaque color
+	TransparentBackground                           // Decode background as fully transparent
+)
+
+// defaultColorKey is the color used as background by 32-bit sprites.
+var defaultColorKey = color.NRGBA{0xfc, 0xe0, 0xfc, 0xff}
+
+type options struct {
+	lazy           bool
+	strict         bool
+	maxPixels      int
+	palette        color.Palette
+	transparency   TransparencyPolicy
+	colorKey       color.NRGBA
+	alphaThreshold uint8
+	dither         DitherMode
+	workers        int
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		transparency:   TransparentBackground,
+		colorKey:       defaultColorKey,
+		alphaThreshold: 0x80,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// palette8 returns the palette to be used for 8-bit sprites.
+func (o *options) palette8() color.Palette {
+	p := o.palette
+	if p == nil {
+		p = sprite8Palette
+	}
+	if len(p) < 256 {
+		// Every index of frame data must have a color.
+		q := make(color.Palette, 256)
+		copy(q, p)
+		for i := len(p); i < len(q); i++ {
+			q[i] = color.NRGBA{0, 0, 0, 0xff}
+		}
+		p = q
+	} else if o.transparency == TransparentBackground {
+		p = append(color.Palette(nil), p...)
+	}
+	if o.transparency == TransparentBackground {
+		r, g, b, _ := rgbaOf(p[0xfe])
+		p[0xfe] = color.NRGBA{r, g, b, 0}
+	}
+	return p
+}
+
+// Lazy makes frames not to be decoded until they're requested by
+// Sprite.Frame. Decoded frames are cached, so the reader must stay readable
+// while the sprite is in use.
+func Lazy() Option {
+	return func(o *options) {
+		o.lazy = true
+	}
+}
+
+// Strict makes OpenSprite reject sprites whose header fields are
+// inconsistent with each other, such as sprite size not matching frame size
+// and count, instead of trusting them.
+func Strict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// MaxPixels makes OpenSprite reject sprites which have more than n pixels in
+// total over all frames. Zero means no limit.
+func MaxPixels(n int) Option {
+	return func(o *options) {
+		o.maxPixels = n
+	}
+}
+
+// Palette sets the color palette used by 8-bit sprites. By default, the
+// palette shared by most of the game's 8-bit sprites is used. Palettes with
+// less than 256 colors are padded with opaque black.
+func Palette(p color.Palette) Option {
+	return func(o *options) {
+		o.palette = p
+	}
+}
+
+// Transparency sets the policy for decoding sprite's background pixels.
+// Default is TransparentBackground, which makes 8-bit sprites' background
+// index 0xfe and 32-bit sprites' color key fully transparent. KeepBackground
+// decodes them as opaque colors instead.
+func Transparency(p TransparencyPolicy) Option {
+	return func(o *options) {
+		o.transparency = p
+	}
+}
+
+// ColorKey sets the color used as background by 32-bit sprites w/o alpha
+// channel. Default is (0xfc, 0xe0, 0xfc), the one 32-bit sprites w/ alpha
+// channel use. Transparent pixels are written as the color key on Save.
+func ColorKey(c color.Color) Option {
+	return func(o *options) {
+		r, g, b, _ := rgbaOf(c)
+		o.colorKey = color.NRGBA{r, g, b, 0xff}
+	}
+}
+
+// AlphaThreshold sets the alpha value below which pixels are considered
+// transparent when converting to a sprite w/o alpha channel. Default is 0x80.
+func AlphaThreshold(a uint8) Option {
+	return func(o *options) {
+		o.alphaThreshold = a
+	}
+}
+
+// Dithering sets the dithering mode used when true color images are quantized
+// to 8-bit palette. Default is NoDither.
+func Dithering(d DitherMode) Option {
+	return func(o *options) {
+		o.dither = d
+	}
+}
+
+// Workers sets the maximum number of goroutines which decode frames at once
+// when opening a sprite. Default is runtime.GOMAXPROCS(0).
+func Workers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
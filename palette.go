@@ -0,0 +1,237 @@
+package gosang
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PaletteFormat is a file format of color palette.
+type PaletteFormat int
+
+// Available palette formats.
+const (
+	PaletteJASC PaletteFormat = iota // JASC-PAL(.pal), used by Paint Shop Pro
+	PaletteACT                       // Adobe Color Table(.act)
+	PaletteGPL                       // GIMP Palette(.gpl)
+	PaletteRaw                       // 256 raw RGB triplets, 768 bytes in total
+)
+
+// ReadPalette reads color palette in format f from r.
+func ReadPalette(r io.Reader, f PaletteFormat) (color.Palette, error) {
+	switch f {
+	default:
+		return nil, errors.Errorf("unknown palette format: %d", f)
+	case PaletteJASC:
+		return readJASCPalette(r)
+	case PaletteACT:
+		return readACTPalette(r)
+	case PaletteGPL:
+		return readGPLPalette(r)
+	case PaletteRaw:
+		return readRawPalette(r)
+	}
+}
+
+// WritePalette writes p to w in format f. Formats which always have 256
+// entries are padded with black.
+func WritePalette(w io.Writer, p color.Palette, f PaletteFormat) error {
+	if len(p) > 256 {
+		return errors.Errorf("too many colors; expected at most 256, got %d", len(p))
+	}
+	switch f {
+	default:
+		return errors.Errorf("unknown palette format: %d", f)
+	case PaletteJASC:
+		return writeJASCPalette(w, p)
+	case PaletteACT:
+		return writeACTPalette(w, p)
+	case PaletteGPL:
+		return writeGPLPalette(w, p)
+	case PaletteRaw:
+		return writeRawPalette(w, p)
+	}
+}
+
+func readJASCPalette(r io.Reader) (color.Palette, error) {
+	s := bufio.NewScanner(r)
+	var lines []string
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read palette")
+	}
+	if len(lines) < 3 || lines[0] != "JASC-PAL" {
+		return nil, errors.New("bad JASC-PAL header")
+	}
+	n, err := strconv.Atoi(lines[2])
+	if err != nil || n < 0 || n > 256 {
+		return nil, errors.Errorf("bad color count: %q", lines[2])
+	}
+	if len(lines)-3 < n {
+		return nil, errors.Errorf("expected %d colors, got %d", n, len(lines)-3)
+	}
+	p := make(color.Palette, n)
+	for i := range p {
+		c, err := parseRGB(lines[3+i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad color #%d", i)
+		}
+		p[i] = c
+	}
+	return p, nil
+}
+
+func writeJASCPalette(w io.Writer, p color.Palette) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "JASC-PAL\r\n0100\r\n%d\r\n", len(p))
+	for _, c := range p {
+		r, g, b, _ := rgbaOf(c)
+		fmt.Fprintf(bw, "%d %d %d\r\n", r, g, b)
+	}
+	if err := bw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write palette")
+	}
+	return nil
+}
+
+func readACTPalette(r io.Reader) (color.Palette, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read palette")
+	}
+	if len(data) != 768 && len(data) != 772 {
+		return nil, errors.Errorf("bad palette size; expected 768 or 772 bytes, got %d", len(data))
+	}
+	n, transparent := 256, -1
+	if len(data) == 772 {
+		n = int(binary.BigEndian.Uint16(data[768:]))
+		if t := binary.BigEndian.Uint16(data[770:]); t != 0xffff {
+			transparent = int(t)
+		}
+		if n == 0 || n > 256 {
+			n = 256
+		}
+	}
+	p := make(color.Palette, n)
+	for i := range p {
+		c := color.NRGBA{data[3*i], data[3*i+1], data[3*i+2], 0xff}
+		if i == transparent {
+			c.A = 0
+		}
+		p[i] = c
+	}
+	return p, nil
+}
+
+func writeACTPalette(w io.Writer, p color.Palette) error {
+	data := make([]byte, 772)
+	transparent := 0xffff
+	for i, c := range p {
+		r, g, b, a := rgbaOf(c)
+		data[3*i], data[3*i+1], data[3*i+2] = r, g, b
+		if a == 0 && transparent == 0xffff {
+			transparent = i
+		}
+	}
+	if len(p) == 256 && transparent == 0xffff {
+		data = data[:768]
+	} else {
+		binary.BigEndian.PutUint16(data[768:], uint16(len(p)))
+		binary.BigEndian.PutUint16(data[770:], uint16(transparent))
+	}
+	if _, err := w.Write(data); err != nil {
+		return errors.Wrap(err, "failed to write palette")
+	}
+	return nil
+}
+
+func readGPLPalette(r io.Reader) (color.Palette, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() || strings.TrimSpace(s.Text()) != "GIMP Palette" {
+		return nil, errors.New("bad GIMP palette header")
+	}
+	var p color.Palette
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "Name:") || strings.HasPrefix(l, "Columns:") {
+			continue
+		}
+		c, err := parseRGB(l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad color #%d", len(p))
+		}
+		if len(p) == 256 {
+			return nil, errors.New("too many colors; expected at most 256")
+		}
+		p = append(p, c)
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read palette")
+	}
+	return p, nil
+}
+
+func writeGPLPalette(w io.Writer, p color.Palette) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "GIMP Palette\nName: gosang\nColumns: 16\n#\n")
+	for i, c := range p {
+		r, g, b, _ := rgbaOf(c)
+		fmt.Fprintf(bw, "%3d %3d %3d\tIndex %d\n", r, g, b, i)
+	}
+	if err := bw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write palette")
+	}
+	return nil
+}
+
+func readRawPalette(r io.Reader) (color.Palette, error) {
+	data := make([]byte, 768)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.Wrap(err, "failed to read palette")
+	}
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.NRGBA{data[3*i], data[3*i+1], data[3*i+2], 0xff}
+	}
+	return p, nil
+}
+
+func writeRawPalette(w io.Writer, p color.Palette) error {
+	data := make([]byte, 768)
+	for i, c := range p {
+		data[3*i], data[3*i+1], data[3*i+2], _ = rgbaOf(c)
+	}
+	if _, err := w.Write(data); err != nil {
+		return errors.Wrap(err, "failed to write palette")
+	}
+	return nil
+}
+
+// parseRGB parses a line starting with three decimal color components, which
+// may be followed by anything like color name.
+func parseRGB(l string) (color.NRGBA, error) {
+	fs := strings.Fields(l)
+	if len(fs) < 3 {
+		return color.NRGBA{}, errors.Errorf("expected 3 components, got %q", l)
+	}
+	var c [3]uint8
+	for i := range c {
+		v, err := strconv.ParseUint(fs[i], 10, 8)
+		if err != nil {
+			return color.NRGBA{}, errors.Errorf("bad component %q", fs[i])
+		}
+		c[i] = uint8(v)
+	}
+	return color.NRGBA{c[0], c[1], c[2], 0xff}, nil
+}
@@ -0,0 +1,51 @@
+package gosang
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Info describes a sprite as its header does, without any frame decoded.
+type Info struct {
+	Kind        Kind
+	FrameWidth  int
+	FrameHeight int
+	FrameCount  int
+	Width       int   // Sprite's width, as stored in the header.
+	Height      int   // Sprite's height, as stored in the header.
+	FrameSizes  []int // Size of each frame's encoded data, in bytes.
+	DataSize    int64 // Total size of frames' encoded data, in bytes.
+}
+
+// Probe reads sprite's header from r and describes the sprite. Only header
+// tables are read, so it's much cheaper than OpenSprite when frames are not
+// needed.
+func Probe(r io.ReaderAt) (Info, error) {
+	var header spriteHeader
+	if err := readField(r, 0, 0, &header); err != nil {
+		return Info{}, errors.Wrap(err, "failed to read header")
+	}
+	sp, err := newSprite(r, header, newOptions(nil))
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{
+		Kind:        sp.Kind(),
+		FrameWidth:  sp.FrameWidth(),
+		FrameHeight: sp.FrameHeight(),
+		FrameCount:  sp.FrameCount(),
+		Width:       sp.Width(),
+		Height:      sp.Height(),
+		FrameSizes:  make([]int, sp.FrameCount()),
+		DataSize:    int64(sp.base().lastOffset),
+	}
+	for i := range info.FrameSizes {
+		size, err := sp.frameSize(i)
+		if err != nil {
+			return Info{}, errors.Wrapf(err, "failed to get frame #%d's size", i)
+		}
+		info.FrameSizes[i] = size
+	}
+	return info, nil
+}
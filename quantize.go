@@ -0,0 +1,141 @@
+package gosang
+
+import (
+	"image"
+	"image/color"
+)
+
+// DitherMode is a method of dithering used when quantizing true color images
+// to 8-bit palette.
+type DitherMode int
+
+// Available dithering modes.
+const (
+	NoDither             DitherMode = iota // Map each pixel to the nearest palette entry
+	FloydSteinbergDither                   // Diffuse quantization error to neighbors
+	OrderedDither                          // Apply 4x4 Bayer matrix threshold
+)
+
+// bayer4 is a 4x4 Bayer threshold matrix used by ordered dithering.
+var bayer4 = [4][4]int{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// orderedDitherSpread is the amount of color change ordered dithering can
+// make to each channel.
+const orderedDitherSpread = 32
+
+// Quantize maps img's colors to 8-bit sprite palette and returns the result
+// as paletted image. Pixels whose alpha is below the alpha threshold are
+// mapped to the background index 0xfe. Palette, AlphaThreshold and Dithering
+// options can be given to change how it's done.
+func Quantize(img image.Image, opts ...Option) *image.Paletted {
+	o := newOptions(opts)
+	return quantize(img, o.palette8(), o.dither, o.alphaThreshold)
+}
+
+func quantize(img image.Image, p color.Palette, d DitherMode, threshold uint8) *image.Paletted {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	dst := image.NewPaletted(image.Rect(0, 0, width, height), p)
+	q := newQuantizer(p)
+	// Quantization errors of current and next row, for Floyd-Steinberg
+	// dithering. Each pixel has three channels, and one more pixel is padded
+	// at both sides.
+	var cur, next []int
+	if d == FloydSteinbergDither {
+		cur, next = make([]int, 3*(width+2)), make([]int, 3*(width+2))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, a := rgbaAt(img, b.Min.X+x, b.Min.Y+y)
+			if a < threshold {
+				dst.SetColorIndex(x, y, 0xfe)
+				continue
+			}
+			c := [3]int{int(r), int(g), int(bl)}
+			switch d {
+			case FloydSteinbergDither:
+				for i := range c {
+					c[i] = clamp8(c[i] + cur[3*(x+1)+i]/16)
+				}
+			case OrderedDither:
+				t := (bayer4[y%4][x%4]*2+1)*orderedDitherSpread/32 - orderedDitherSpread/2
+				for i := range c {
+					c[i] = clamp8(c[i] + t)
+				}
+			}
+			ci := q.index(uint8(c[0]), uint8(c[1]), uint8(c[2]))
+			dst.SetColorIndex(x, y, ci)
+			if d == FloydSteinbergDither {
+				pr, pg, pb, _ := rgbaOf(p[ci])
+				for i, v := range [3]uint8{pr, pg, pb} {
+					e := c[i] - int(v)
+					cur[3*(x+2)+i] += e * 7
+					next[3*x+i] += e * 3
+					next[3*(x+1)+i] += e * 5
+					next[3*(x+2)+i] += e
+				}
+			}
+		}
+		if d == FloydSteinbergDither {
+			cur, next = next, cur
+			for i := range next {
+				next[i] = 0
+			}
+		}
+	}
+	return dst
+}
+
+// quantizer finds the nearest palette entry for colors, caching results.
+type quantizer struct {
+	p     color.Palette
+	cache map[uint32]uint8
+}
+
+func newQuantizer(p color.Palette) *quantizer {
+	return &quantizer{p, make(map[uint32]uint8)}
+}
+
+func (q *quantizer) index(r, g, b uint8) uint8 {
+	k := uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+	if ci, ok := q.cache[k]; ok {
+		return ci
+	}
+	ci := nearestIndex(q.p, r, g, b)
+	q.cache[k] = ci
+	return ci
+}
+
+func clamp8(v int) int {
+	if v < 0 {
+		return 0
+	} else if v > 0xff {
+		return 0xff
+	}
+	return v
+}
+
+// nearestIndex returns index of the palette entry closest to given color,
+// except the background index 0xfe.
+func nearestIndex(p color.Palette, r, g, b uint8) uint8 {
+	best, bestDist := 0, -1
+	for i, c := range p {
+		if i == 0xfe {
+			continue
+		}
+		cr, cg, cb, _ := rgbaOf(c)
+		dr, dg, db := int(cr)-int(r), int(cg)-int(g), int(cb)-int(b)
+		if d := dr*dr + dg*dg + db*db; bestDist < 0 || d < bestDist {
+			best, bestDist = i, d
+			if d == 0 {
+				break
+			}
+		}
+	}
+	return uint8(best)
+}
@@ -0,0 +1,34 @@
+// Package register registers Gersang sprite formats with the image package,
+// so that image.Decode and image.DecodeConfig recognize them. It's meant to
+// be imported for its side effect only:
+//
+//	import _ "github.com/hallazzang/gosang/register"
+//
+// Decoded image is the sprite's first frame. Format names are "spr" for 8-bit
+// sprites, "s32" for 32-bit sprites w/o alpha channel and "s32alpha" for
+// 32-bit sprites w/ alpha channel.
+package register
+
+import (
+	"encoding/binary"
+	"image"
+
+	"github.com/hallazzang/gosang"
+)
+
+var formats = []struct {
+	name string
+	kind gosang.Kind
+}{
+	{"spr", gosang.Kind8},
+	{"s32", gosang.Kind32},
+	{"s32alpha", gosang.Kind32Alpha},
+}
+
+func init() {
+	for _, f := range formats {
+		magic := make([]byte, 4)
+		binary.LittleEndian.PutUint32(magic, f.kind.Signature())
+		image.RegisterFormat(f.name, string(magic), gosang.Decode, gosang.DecodeConfig)
+	}
+}
@@ -0,0 +1,56 @@
+package register
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format string
+		width  int
+		height int
+		model  color.Model
+	}{
+		{"arrow.spr", "spr", 20, 20, nil},
+		{"BUTTMENU_ONLINE_1.S32", "s32", 24, 52, color.NRGBAModel},
+		{"WindCutter.S32", "s32alpha", 640, 480, color.NRGBAModel},
+	} {
+		func() {
+			f, err := os.Open(filepath.Join("..", "test", "data", tc.name))
+			if err != nil {
+				t.Fatalf("sprite %q: failed to open file: %v", tc.name, err)
+			}
+			defer f.Close()
+			cfg, format, err := image.DecodeConfig(f)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to decode config: %v", tc.name, err)
+			}
+			if format != tc.format {
+				t.Errorf("sprite %q: bad format; expected %q, got %q", tc.name, tc.format, format)
+			}
+			if cfg.Width != tc.width || cfg.Height != tc.height {
+				t.Errorf("sprite %q: bad size; expected %dx%d, got %dx%d", tc.name, tc.width, tc.height, cfg.Width, cfg.Height)
+			}
+			if _, ok := cfg.ColorModel.(color.Palette); tc.model == nil && !ok {
+				t.Errorf("sprite %q: expected palette as color model, got %T", tc.name, cfg.ColorModel)
+			} else if tc.model != nil && cfg.ColorModel != tc.model {
+				t.Errorf("sprite %q: bad color model", tc.name)
+			}
+			if _, err := f.Seek(0, 0); err != nil {
+				t.Fatalf("sprite %q: failed to rewind file: %v", tc.name, err)
+			}
+			img, format, err := image.Decode(f)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to decode image: %v", tc.name, err)
+			}
+			if b := img.Bounds(); format != tc.format || b.Dx() != tc.width || b.Dy() != tc.height {
+				t.Errorf("sprite %q: bad image; expected %s %dx%d, got %s %dx%d", tc.name, tc.format, tc.width, tc.height, format, b.Dx(), b.Dy())
+			}
+		}()
+	}
+}
@@ -0,0 +1,145 @@
+package gosang
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Salvage opens damaged sprite from r, recovering as many frames as possible.
+// Frames which can't be fully decoded are replaced by partially decoded
+// images, or blank images if nothing could be decoded. Frames whose offset
+// table entry is wrong are searched for right after the previous frame, by
+// scanning its rows. Every problem found is reported, and saving returned
+// sprite writes a repaired sprite. It fails only if the header itself is
+// unusable.
+func Salvage(r io.ReaderAt, opts ...Option) (Sprite, []Problem, error) {
+	o := newOptions(opts)
+	o.strict = false
+	var ps []Problem
+	report := func(frame int, offset int64, format string, args ...interface{}) {
+		ps = append(ps, Problem{frame, offset, fmt.Sprintf(format, args...)})
+	}
+	var header spriteHeader
+	if err := readField(r, 0, 0, &header); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read header")
+	}
+	if header.FrameWidth == 0 || header.FrameHeight == 0 {
+		return nil, nil, errors.Errorf("invalid frame size: %dx%d", header.FrameWidth, header.FrameHeight)
+	}
+	if header.FrameCount > maxFrameCount {
+		report(-1, 12, "frame count %d exceeds offset table size %d; only first %d frames are recovered", header.FrameCount, maxFrameCount, maxFrameCount)
+		header.FrameCount = maxFrameCount
+	}
+	sp, err := newSprite(r, header, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := sp.base()
+	// Make sure that there's enough data for at least one frame before
+	// allocating any image, so bogus frame size can't exhaust memory. Sprites
+	// w/o frames need no data.
+	if b.frameCount > 0 {
+		need := int64(uint64(b.frameWidth)*uint64(b.frameHeight)/128) + 1
+		if _, err := r.ReadAt(make([]byte, 1), sp.dataOffset()+need-1); err != nil {
+			return nil, nil, errors.Errorf("frame data is too short for %dx%d frames", b.frameWidth, b.frameHeight)
+		}
+	}
+	if w, h := b.frameWidth*b.frameCount, b.frameHeight; b.width != w || b.height != h {
+		report(-1, -1, "sprite size %dx%d doesn't match frames; fixed to %dx%d", b.width, b.height, w, h)
+		b.width, b.height = w, h
+	}
+	next, nextKnown := uint32(0), true // Where the next frame is expected to be.
+	for i := 0; i < int(b.frameCount); i++ {
+		offset, size, ok := salvageOffset(sp, b.offsets[i], next, nextKnown)
+		if !ok {
+			fr := b.offsets[i]
+			if nextKnown {
+				fr = next
+			}
+			img, err := salvageFrame(sp, fr)
+			start := sp.dataOffset() + int64(fr)
+			var fe *FormatError
+			if errors.As(err, &fe) && fe.Row >= 0 {
+				report(i, start+fe.Offset, "row %d, column %d: %v; frame is partially recovered", fe.Row, fe.Column, fe.Err)
+			} else {
+				report(i, start, "%v; frame is replaced with blank image", err)
+			}
+			b.frames[i] = newFrame(sp, i, img)
+			b.offsets[i], b.sizes[i] = noOffset, 0
+			nextKnown = false
+			continue
+		}
+		if offset != b.offsets[i] {
+			report(i, offsetsOffset+4*int64(i), "frame offset %d is wrong; frame found at %d", b.offsets[i], offset)
+		}
+		b.offsets[i], b.sizes[i] = offset, size
+		next, nextKnown = offset+size, true
+	}
+	if !o.lazy {
+		if err := loadFrames(sp, o.workers); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sp, ps, nil
+}
+
+// salvageOffset finds where frame data of sp is, trying the offset from the
+// offset table first, then next where it's expected to be. It returns found
+// offset and size of the frame data.
+func salvageOffset(sp Sprite, offset, next uint32, nextKnown bool) (uint32, uint32, bool) {
+	candidates := []uint32{offset}
+	if nextKnown && next != offset {
+		candidates = append(candidates, next)
+	}
+	for _, c := range candidates {
+		if c == noOffset {
+			continue
+		}
+		br := bufio.NewReader(&offsetedReader{sp.base().r, sp.dataOffset() + int64(c)})
+		n, err := scanFrame(sp.Kind(), br, sp.FrameWidth(), sp.FrameHeight())
+		if err == nil && n <= int64(noOffset-c) {
+			return c, uint32(n), true
+		}
+	}
+	return 0, 0, false
+}
+
+// salvageFrame decodes as much of the frame data at offset as possible. Blank
+// image is returned if nothing could be decoded.
+func salvageFrame(sp Sprite, offset uint32) (image.Image, error) {
+	var img image.Image
+	err := errors.New("frame data not found")
+	if offset != noOffset {
+		// Frame size is unknown, so read as much as a frame can take.
+		var data []byte
+		data, err = readFrameData(sp, &offsetedReader{sp.base().r, sp.dataOffset() + int64(offset)}, math.MaxInt32)
+		if err == nil {
+			err = checkFrameData(sp, -1, len(data))
+		}
+		if err == nil {
+			img, err = sp.decodeFrame(data)
+		}
+	}
+	if img == nil {
+		img = blankFrame(sp)
+	}
+	return img, err
+}
+
+// blankFrame creates frame image of sp filled with background.
+func blankFrame(sp Sprite) image.Image {
+	r := image.Rect(0, 0, sp.FrameWidth(), sp.FrameHeight())
+	if sp.Kind() == Kind8 {
+		img := image.NewPaletted(r, sp.Palette())
+		for i := range img.Pix {
+			img.Pix[i] = 0xfe
+		}
+		return img
+	}
+	return image.NewNRGBA(r)
+}
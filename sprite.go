@@ -1,67 +1,336 @@
 package gosang
 
 import (
+	"bytes"
 	"encoding/binary"
+	"image"
+	"image/color"
 	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
 
 // Sprite represents single sprite. It can either be 8-bit or 32-bit sprite.
+// Sprites are safe for concurrent use by multiple goroutines. Frames being
+// decoded concurrently are decoded in parallel, and edits wait until they're
+// done.
 type Sprite interface {
-	ColorBits() int   // Color bits. 8 or 32.
-	HasAlpha() bool   // Whether frame has alpha channel or not.
-	FrameWidth() int  // Frame's width in pixels.
-	FrameHeight() int // Frame's height in pixels.
+	Kind() Kind             // Kind of sprite format.
+	ColorBits() int         // Color bits. 8 or 32.
+	HasAlpha() bool         // Whether frame has alpha channel or not.
+	Palette() color.Palette // Color palette. nil for 32-bit sprites.
+	FrameWidth() int        // Frame's width in pixels.
+	FrameHeight() int       // Frame's height in pixels.
 	FrameCount() int
 	Width() int
 	Height() int
-	Frame(idx int) (*Frame, error) // Specific frame's data.
-	Save(w io.Writer) error        // Write sprite data to w.
+	Frame(idx int) (*Frame, error)              // Specific frame's data.
+	SetFrame(idx int, img image.Image) error    // Replace specific frame's image.
+	InsertFrame(idx int, img image.Image) error // Insert new frame before idx.
+	DeleteFrame(idx int) error                  // Delete specific frame.
+	AppendFrame(img image.Image) error          // Append new frame at the end.
+	RawFrame(idx int) ([]byte, error)           // Specific frame's encoded data.
+	InsertRawFrame(idx int, data []byte) error  // Insert new encoded frame before idx.
+	AppendRawFrame(data []byte) error           // Append new encoded frame at the end.
+	Save(w io.Writer) error                     // Write sprite data to w.
 
+	dataOffset() int64
 	frameOffset(idx int) (int64, error)
 	frameSize(idx int) (int, error)
-	loadFrame(idx int) (*Frame, error)
+	decodeFrame(data []byte) (image.Image, error) // Partially decoded image is returned with error.
+	base() *sprite
+	encodeFrame(dst []byte, idx int) ([]byte, error) // Encoded frame is appended to dst.
 }
 
 // OpenSprite creates new sprite from r. It can accept all three type of
 // sprites: 8-bit sprite(.spr), 32-bit sprite w/o alpha channel, 32-bit
-// sprite w/ alpha channel.
-func OpenSprite(r io.ReaderAt) (Sprite, error) {
+// sprite w/ alpha channel. Frames are decoded in parallel, as r is read
+// concurrently. Data of unmodified frames is read from r again by RawFrame and
+// Save, so r must stay readable while the sprite is in use. Options can be
+// given to change how the sprite is decoded.
+func OpenSprite(r io.ReaderAt, opts ...Option) (Sprite, error) {
+	o := newOptions(opts)
 	var header spriteHeader
-	if err := binary.Read(&offsetedReader{r, 0}, binary.LittleEndian, &header); err != nil {
+	if err := readField(r, 0, 0, &header); err != nil {
 		return nil, errors.Wrap(err, "failed to read header")
 	}
-	var sp Sprite
-	var err error
-	switch header.Signature {
-	default:
-		return nil, errors.Errorf("bad signature; expected 0x9 or 0xf, got %#x", header.Signature)
-	case 0x09:
-		sp, err = newSprite8(r, header)
-	case 0x0f:
-		sp, err = newSprite32(r, header)
-	case 0x19:
-		sp, err = newSprite32Alpha(r, header)
+	sp, err := newSprite(r, header, o)
+	if err != nil {
+		return nil, err
+	}
+	if !o.lazy {
+		if err := loadFrames(sp, o.workers); err != nil {
+			return nil, err
+		}
+	}
+	return sp, nil
+}
+
+// loadFrames decodes all frames of sp using at most workers goroutines.
+func loadFrames(sp Sprite, workers int) error {
+	return forEachFrame(sp.FrameCount(), workers, func(i int) error {
+		if _, err := sp.Frame(i); err != nil {
+			return errors.Wrapf(err, "failed to load frame #%d", i)
+		}
+		return nil
+	})
+}
+
+// forEachFrame calls f for frame indices from 0 to n-1 using at most workers
+// goroutines, or runtime.GOMAXPROCS(0) goroutines if workers isn't positive.
+// It stops at the first error, and returns error of the first frame which
+// has failed.
+func forEachFrame(n, workers int, f func(i int) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	errs := make([]error, n)
+	next, failed := int64(-1), int32(0)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				if errs[i] = f(i); errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSprite creates sprite described by header, reading rest of the header
+// tables from r.
+func newSprite(r io.ReaderAt, header spriteHeader, o *options) (Sprite, error) {
+	if o.maxPixels > 0 && uint64(header.FrameWidth)*uint64(header.FrameHeight)*uint64(header.FrameCount) > uint64(o.maxPixels) {
+		return nil, errors.Errorf("sprite exceeds pixel budget of %d pixels", o.maxPixels)
+	}
+	kind, ok := KindOf(header.Signature)
+	if !ok {
+		return nil, errors.Wrapf(ErrBadSignature, "expected one of %s, got %#x", signatureList(), header.Signature)
+	}
+	if header.FrameWidth == 0 || header.FrameHeight == 0 {
+		// Frames w/o pixels take no data, so nothing else bounds them.
+		return nil, errors.Errorf("invalid frame size: %dx%d", header.FrameWidth, header.FrameHeight)
+	}
+	if header.FrameCount > maxFrameCount {
+		return nil, errors.Errorf("too many frames; expected at most %d, got %d", maxFrameCount, header.FrameCount)
+	}
+	sp := kinds[kind].create(o)
+	if err := sp.base().load(r, header); err != nil {
+		return nil, err
+	}
+	if o.strict {
+		if err := checkSprite(sp); err != nil {
+			return nil, errors.Wrap(err, "invalid sprite")
+		}
 	}
-	for i := uint32(0); i < header.FrameCount; i++ {
-		if _, err := sp.loadFrame(int(i)); err != nil {
-			return nil, errors.Wrapf(err, "failed to load frame #%d", i)
+	return sp, nil
+}
+
+// OpenSpriteLazy is like OpenSprite, but it doesn't decode any frame until
+// it's requested by Sprite.Frame. It's a shorthand for OpenSprite(r, Lazy()).
+func OpenSpriteLazy(r io.ReaderAt) (Sprite, error) {
+	return OpenSprite(r, Lazy())
+}
+
+// maxFrameCount is the number of entries in sprite's frame offset table.
+const maxFrameCount = 300
+
+// noOffset is the offset of frames which have no backing data.
+const noOffset = ^uint32(0)
+
+// NewSprite creates new sprite of given kind from frames. Every frame image
+// must be exactly frameWidth x frameHeight in size. Created sprite has no
+// backing data, so it can only be saved. Palette option is used by 8-bit
+// sprites to map frame images' colors.
+func NewSprite(kind Kind, frameWidth, frameHeight int, frames []image.Image, opts ...Option) (Sprite, error) {
+	o := newOptions(opts)
+	if frameWidth <= 0 || frameHeight <= 0 {
+		return nil, errors.Errorf("invalid frame size: %dx%d", frameWidth, frameHeight)
+	}
+	if len(frames) > maxFrameCount {
+		return nil, errors.Errorf("too many frames; expected at most %d, got %d", maxFrameCount, len(frames))
+	}
+	for i, img := range frames {
+		if err := checkFrameImage(img, frameWidth, frameHeight); err != nil {
+			return nil, errors.Wrapf(err, "bad frame #%d", i)
 		}
 	}
-	return sp, err
+	ki, ok := kinds[kind]
+	if !ok {
+		return nil, errors.Errorf("unknown sprite kind: %v", kind)
+	}
+	sp := ki.create(o)
+	b := sp.base()
+	b.frameWidth = uint32(frameWidth)
+	b.frameHeight = uint32(frameHeight)
+	b.frameCount = uint32(len(frames))
+	b.offsets = make([]uint32, len(frames))
+	b.sizes = make([]uint32, len(frames))
+	b.width = uint32(frameWidth * len(frames))
+	b.height = uint32(frameHeight)
+	b.frames = make([]*Frame, len(frames))
+	for i, img := range frames {
+		b.offsets[i] = noOffset
+		b.frames[i] = newFrame(sp, i, img)
+	}
+	return sp, nil
 }
 
 type sprite struct {
+	// mu guards frames and all fields which are changed by editing frames.
+	// Frames are decoded with read lock held, and edits take write lock.
+	mu sync.RWMutex
+
+	outer       Sprite // Sprite which embeds this
 	r           io.ReaderAt
 	frameWidth  uint32
 	frameHeight uint32
 	frameCount  uint32
 	offsets     []uint32
+	sizes       []uint32 // Frame sizes known from offsets. 0 if unknown.
 	width       uint32
 	height      uint32
 	lastOffset  uint32
 	frames      []*Frame
+	version     uint64 // Incremented on every edit of frames.
+
+	// Original header bytes and frame count, kept to preserve unknown
+	// regions of the header on Save.
+	rawHeader     []byte
+	rawFrameCount uint32
+}
+
+func (sp *sprite) base() *sprite {
+	return sp
+}
+
+// layout returns layout of the sprite's kind.
+func (sp *sprite) layout() *layout {
+	return &kinds[sp.outer.Kind()].layout
+}
+
+// load reads header tables of sprite described by header from r.
+func (sp *sprite) load(r io.ReaderAt, header spriteHeader) error {
+	kind, l := sp.outer.Kind(), sp.layout()
+	sp.r = r
+	sp.frameWidth = header.FrameWidth
+	sp.frameHeight = header.FrameHeight
+	sp.frameCount = header.FrameCount
+	sp.offsets = make([]uint32, header.FrameCount)
+	sp.frames = make([]*Frame, header.FrameCount)
+	if err := sp.readRawHeader(int(l.data)); err != nil {
+		return err
+	}
+	if err := readField(r, kind, offsetsOffset, &sp.offsets); err != nil {
+		return errors.Wrap(err, "failed to read frame offsets")
+	}
+	sp.initSizes()
+	if err := readField(r, kind, l.dataSize, &sp.lastOffset); err != nil {
+		return errors.Wrap(err, "failed to read sprite's last data offset")
+	}
+	if err := readField(r, kind, l.dataSize+4, &sp.width); err != nil {
+		return errors.Wrap(err, "failed to read sprite width")
+	}
+	if err := readField(r, kind, l.dataSize+8, &sp.height); err != nil {
+		return errors.Wrap(err, "failed to read sprite height")
+	}
+	return nil
+}
+
+func (sp *sprite) dataOffset() int64 {
+	return sp.layout().data
+}
+
+func (sp *sprite) Save(w io.Writer) error {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	kind, l := sp.outer.Kind(), sp.layout()
+	frames, err := sp.rawFrames()
+	if err != nil {
+		return err
+	}
+	offsets := make([]uint32, sp.frameCount)
+	sizes := make([]uint32, sp.frameCount)
+	offset := uint32(0)
+	for i, data := range frames {
+		size := len(data) / l.sizeUnit
+		if l.sizeEntry == 2 && size > 0xffff {
+			return errors.Errorf("encoded frame #%d is too large: %d bytes", i, len(data))
+		}
+		offsets[i] = offset
+		sizes[i] = uint32(size)
+		offset += uint32(len(data))
+	}
+	header := spriteHeader{
+		Signature:   kind.Signature(),
+		FrameWidth:  sp.frameWidth,
+		FrameHeight: sp.frameHeight,
+		FrameCount:  sp.frameCount,
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return errors.Wrap(err, "failed to write sprite header")
+	}
+	if err := sp.writeRawHeader(w, 16, offsetsOffset); err != nil {
+		return errors.Wrap(err, "failed to write header padding")
+	}
+	if err := binary.Write(w, binary.LittleEndian, offsets); err != nil {
+		return errors.Wrap(err, "failed to write frame offsets")
+	}
+	if err := sp.writeTableGap(w, offsetsOffset, 4, int(l.sizes)); err != nil {
+		return errors.Wrap(err, "failed to write header padding")
+	}
+	if err := binary.Write(w, binary.LittleEndian, l.sizeTable(sizes)); err != nil {
+		return errors.Wrap(err, "failed to write encoded frame sizes")
+	}
+	if err := sp.writeTableGap(w, int(l.sizes), l.sizeEntry, int(l.dataSize)); err != nil {
+		return errors.Wrap(err, "failed to write header padding")
+	}
+	if err := binary.Write(w, binary.LittleEndian, offset); err != nil {
+		return errors.Wrap(err, "failed to write frame data size")
+	}
+	if err := binary.Write(w, binary.LittleEndian, sp.width); err != nil {
+		return errors.Wrap(err, "failed to write frame width")
+	}
+	if err := binary.Write(w, binary.LittleEndian, sp.height); err != nil {
+		return errors.Wrap(err, "failed to write frame height")
+	}
+	if err := sp.writeRawHeader(w, int(l.dataSize)+12, int(l.data)); err != nil {
+		return errors.Wrap(err, "failed to write header padding")
+	}
+	for _, data := range frames {
+		if _, err := w.Write(data); err != nil {
+			return errors.Wrap(err, "failed to write frame data")
+		}
+	}
+	return nil
+}
+
+func (sp *sprite) ColorBits() int {
+	return sp.outer.Kind().ColorBits()
+}
+
+func (sp *sprite) HasAlpha() bool {
+	return sp.outer.Kind().HasAlpha()
 }
 
 func (sp *sprite) FrameWidth() int {
@@ -73,45 +342,417 @@ func (sp *sprite) FrameHeight() int {
 }
 
 func (sp *sprite) FrameCount() int {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
 	return int(sp.frameCount)
 }
 
 func (sp *sprite) Width() int {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
 	return int(sp.width)
 }
 
 func (sp *sprite) Height() int {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
 	return int(sp.height)
 }
 
+func (sp *sprite) Palette() color.Palette {
+	return nil
+}
+
 func (sp *sprite) Frame(idx int) (*Frame, error) {
-	if idx < 0 || idx > int(sp.frameCount-1) {
-		return nil, errors.New("frame index out of range")
+	sp.mu.RLock()
+	if idx < 0 || idx >= int(sp.frameCount) {
+		sp.mu.RUnlock()
+		return nil, ErrFrameOutOfRange
+	}
+	fr := sp.frames[idx]
+	if fr != nil && fr.img != nil {
+		sp.mu.RUnlock()
+		return fr, nil
 	}
-	return sp.frames[idx], nil
+	img, err := sp.decodeFrameAt(idx)
+	version := sp.version
+	sp.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.version != version {
+		// Frames have been edited while decoding, so the decoded frame can't
+		// be cached anymore.
+		return newFrame(sp.outer, idx, img), nil
+	}
+	if cur := sp.frames[idx]; cur != nil && cur.img != nil {
+		return cur, nil // Decoded by another goroutine meanwhile.
+	}
+	if fr == nil {
+		fr = newFrame(sp.outer, idx, img)
+		sp.frames[idx] = fr
+	} else {
+		fr.img = img
+	}
+	return fr, nil
+}
+
+// decodeFrameAt decodes frame which isn't decoded yet, either from its raw
+// data or from the backing data. Caller must hold sp.mu.
+func (sp *sprite) decodeFrameAt(idx int) (image.Image, error) {
+	if fr := sp.frames[idx]; fr != nil {
+		if err := checkFrameData(sp.outer, idx, len(fr.raw)); err != nil {
+			return nil, err
+		}
+		img, err := sp.outer.decodeFrame(fr.raw)
+		if err != nil {
+			return nil, locateError(err, idx, 0)
+		}
+		return img, nil
+	}
+	size, err := sp.frameSize(idx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFrameData(sp.outer, idx, size); err != nil {
+		return nil, err
+	}
+	offset := sp.outer.dataOffset() + int64(sp.offsets[idx])
+	data, err := readFrameData(sp.outer, &offsetedReader{sp.r, offset}, size)
+	if err != nil {
+		err = newFormatError(sp.outer.Kind(), -1, -1, int64(len(data)), err)
+		return nil, errors.Wrap(locateError(err, idx, offset), "failed to read frame data")
+	}
+	// Size can't be trusted, so check again with the data actually read
+	// before the frame's image is allocated.
+	if err := checkFrameData(sp.outer, idx, len(data)); err != nil {
+		return nil, err
+	}
+	img, err := sp.outer.decodeFrame(data)
+	if err != nil {
+		return nil, locateError(err, idx, offset)
+	}
+	return img, nil
+}
+
+// readFrameData reads encoded frame data which is size bytes long from r.
+// Frame data can't take more than 4 bytes per pixel, so size is capped at
+// that. Data is read through a buffer rather than allocated up front, since
+// size can't be trusted until the data has actually been read. Data shorter
+// than size is returned without error, so that decoders can tell where it's
+// truncated.
+func readFrameData(sp Sprite, r io.Reader, size int) ([]byte, error) {
+	if max := uint64(sp.FrameWidth()) * uint64(sp.FrameHeight()) * 4; uint64(size) > max {
+		size = int(max)
+	}
+	buf := new(bytes.Buffer)
+	if size < 1<<16 {
+		buf.Grow(size)
+	} else {
+		buf.Grow(1 << 16)
+	}
+	_, err := buf.ReadFrom(io.LimitReader(r, int64(size)))
+	return buf.Bytes(), err
+}
+
+func (sp *sprite) SetFrame(idx int, img image.Image) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if idx < 0 || idx >= int(sp.frameCount) {
+		return ErrFrameOutOfRange
+	}
+	if err := checkFrameImage(img, int(sp.frameWidth), int(sp.frameHeight)); err != nil {
+		return err
+	}
+	sp.frames[idx] = newFrame(sp.outer, idx, img)
+	sp.offsets[idx], sp.sizes[idx] = noOffset, 0
+	sp.version++
+	return nil
+}
+
+func (sp *sprite) InsertFrame(idx int, img image.Image) error {
+	if err := checkFrameImage(img, int(sp.frameWidth), int(sp.frameHeight)); err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.insertFrame(idx, newFrame(sp.outer, idx, img))
+}
+
+// InsertRawFrame inserts new frame whose data is already encoded for the
+// sprite's kind, such as one returned by RawFrame of another sprite of the
+// same kind and frame size. data is checked to hold exactly one frame, but
+// is not decoded until the frame is requested, and is written as-is on Save.
+// data must not be modified afterwards.
+func (sp *sprite) InsertRawFrame(idx int, data []byte) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.insertRawFrame(idx, data)
+}
+
+func (sp *sprite) AppendRawFrame(data []byte) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.insertRawFrame(int(sp.frameCount), data)
+}
+
+func (sp *sprite) insertRawFrame(idx int, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("frame data is empty")
+	}
+	n, err := scanFrame(sp.outer.Kind(), bytes.NewReader(data), int(sp.frameWidth), int(sp.frameHeight))
+	if err != nil {
+		return errors.Wrap(err, "invalid frame data")
+	} else if n != int64(len(data)) {
+		return errors.Errorf("invalid frame data: %d extra bytes", int64(len(data))-n)
+	}
+	fr := newFrame(sp.outer, idx, nil)
+	fr.raw = data
+	return sp.insertFrame(idx, fr)
+}
+
+// insertFrame inserts fr before idx. Caller must hold sp.mu for writing.
+func (sp *sprite) insertFrame(idx int, fr *Frame) error {
+	if idx < 0 || idx > int(sp.frameCount) {
+		return ErrFrameOutOfRange
+	}
+	if sp.frameCount >= maxFrameCount {
+		return errors.Errorf("too many frames; expected at most %d", maxFrameCount)
+	}
+	sp.offsets = append(sp.offsets, 0)
+	copy(sp.offsets[idx+1:], sp.offsets[idx:])
+	sp.offsets[idx] = noOffset
+	sp.sizes = append(sp.sizes, 0)
+	copy(sp.sizes[idx+1:], sp.sizes[idx:])
+	sp.sizes[idx] = 0
+	sp.frames = append(sp.frames, nil)
+	copy(sp.frames[idx+1:], sp.frames[idx:])
+	sp.frames[idx] = fr
+	sp.frameCount++
+	sp.reindexFrames(idx + 1)
+	return nil
+}
+
+func (sp *sprite) DeleteFrame(idx int) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if idx < 0 || idx >= int(sp.frameCount) {
+		return ErrFrameOutOfRange
+	}
+	sp.offsets = append(sp.offsets[:idx], sp.offsets[idx+1:]...)
+	sp.sizes = append(sp.sizes[:idx], sp.sizes[idx+1:]...)
+	sp.frames = append(sp.frames[:idx], sp.frames[idx+1:]...)
+	sp.frameCount--
+	sp.reindexFrames(idx)
+	return nil
+}
+
+func (sp *sprite) AppendFrame(img image.Image) error {
+	if err := checkFrameImage(img, int(sp.frameWidth), int(sp.frameHeight)); err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.insertFrame(int(sp.frameCount), newFrame(sp.outer, int(sp.frameCount), img))
+}
+
+// RawFrame returns frame's encoded data. Data of frames which haven't been
+// modified is returned as-is, whether they've been decoded or not, and other
+// frames are encoded. The returned slice must not be modified.
+func (sp *sprite) RawFrame(idx int) ([]byte, error) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.rawFrame(idx)
+}
+
+// rawFrame is like RawFrame, but caller must hold sp.mu.
+func (sp *sprite) rawFrame(idx int) ([]byte, error) {
+	if idx < 0 || idx >= int(sp.frameCount) {
+		return nil, ErrFrameOutOfRange
+	}
+	fr := sp.frames[idx]
+	switch {
+	case fr == nil || sp.offsets[idx] != noOffset:
+		// Frame is unmodified, so its backing data is returned as-is, which
+		// may be encoded differently from what encodeFrame writes.
+		offset, err := sp.frameOffset(idx)
+		if err != nil {
+			return nil, err
+		}
+		size, err := sp.frameSize(idx)
+		if err != nil {
+			return nil, err
+		}
+		// Read through a buffer rather than allocating size bytes up front,
+		// since size can't be trusted until the data has actually been read.
+		buf := new(bytes.Buffer)
+		n, err := buf.ReadFrom(io.NewSectionReader(sp.r, sp.outer.dataOffset()+offset, int64(size)))
+		if err == nil && n < int64(size) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, errors.Wrap(locateError(newFormatError(sp.outer.Kind(), -1, -1, n, err), idx, sp.outer.dataOffset()+offset), "failed to read frame data")
+		}
+		return buf.Bytes(), nil
+	case fr.raw != nil:
+		return fr.raw, nil
+	default:
+		return sp.outer.encodeFrame(nil, idx)
+	}
+}
+
+// rawFrames returns encoded data of all frames, encoding them in parallel.
+// Caller must hold sp.mu.
+func (sp *sprite) rawFrames() ([][]byte, error) {
+	frames := make([][]byte, sp.frameCount)
+	err := forEachFrame(len(frames), 0, func(i int) error {
+		data, err := sp.rawFrame(i)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode frame #%d", i)
+		}
+		frames[i] = data
+		return nil
+	})
+	return frames, err
+}
+
+// initSizes calculates frame sizes from frame offsets. Last frame's size is
+// left unknown, since it depends on the total data size, and so are sizes of
+// frames whose offsets are out of order.
+func (sp *sprite) initSizes() {
+	sp.sizes = make([]uint32, len(sp.offsets))
+	for i := 0; i+1 < len(sp.offsets); i++ {
+		if sp.offsets[i+1] >= sp.offsets[i] {
+			sp.sizes[i] = sp.offsets[i+1] - sp.offsets[i]
+		}
+	}
+}
+
+// reindexFrames updates frame indices and sprite width after frames from
+// start have been moved.
+func (sp *sprite) reindexFrames(start int) {
+	for i := start; i < len(sp.frames); i++ {
+		if sp.frames[i] != nil {
+			sp.frames[i].idx = i
+		}
+	}
+	sp.width = sp.frameWidth * sp.frameCount
+	sp.version++
 }
 
 func (sp *sprite) frameOffset(idx int) (int64, error) {
-	if idx < 0 || idx > int(sp.frameCount-1) {
-		return 0, errors.New("frame index out of range")
+	if idx < 0 || idx >= int(sp.frameCount) {
+		return 0, ErrFrameOutOfRange
+	}
+	if sp.offsets[idx] == noOffset {
+		return 0, errors.New("frame has no backing data")
 	}
 	return int64(sp.offsets[idx]), nil
 }
 
 func (sp *sprite) frameSize(idx int) (int, error) {
-	if idx < 0 || idx > int(sp.frameCount-1) {
-		return 0, errors.New("frame index out of range")
-	} else if idx < int(sp.frameCount-1) {
-		return int(sp.offsets[idx+1] - sp.offsets[idx]), nil
+	if idx < 0 || idx >= int(sp.frameCount) {
+		return 0, ErrFrameOutOfRange
 	}
-	if sp.lastOffset == 0 {
-		if err := binary.Read(&offsetedReader{sp.r, 0xe20}, binary.LittleEndian, &sp.lastOffset); err != nil {
-			return 0, errors.Wrap(err, "failed to read sprite's last data offset")
-		}
+	if sp.offsets[idx] == noOffset {
+		return 0, errors.New("frame has no backing data")
+	} else if sp.sizes[idx] != 0 {
+		return int(sp.sizes[idx]), nil
+	}
+	if sp.lastOffset < sp.offsets[idx] {
+		return 0, &FormatError{sp.outer.Kind(), idx, -1, -1, -1, errors.Errorf("frame offset %d is beyond frame data size %d", sp.offsets[idx], sp.lastOffset)}
 	}
 	return int(sp.lastOffset - sp.offsets[idx]), nil
 }
 
+// readRawHeader reads first n bytes of sprite data, which include all header
+// tables, from sp.r.
+func (sp *sprite) readRawHeader(n int) error {
+	sp.rawHeader = make([]byte, n)
+	if _, err := io.ReadFull(&offsetedReader{sp.r, 0}, sp.rawHeader); err != nil {
+		return errors.Wrap(err, "failed to read raw header")
+	}
+	sp.rawFrameCount = sp.frameCount
+	return nil
+}
+
+// writeRawHeader writes original header bytes in [start, end) to w. Zeros are
+// written instead if the sprite has no original header.
+func (sp *sprite) writeRawHeader(w io.Writer, start, end int) error {
+	if end > len(sp.rawHeader) {
+		return advanceWriter(w, end-start)
+	}
+	if _, err := w.Write(sp.rawHeader[start:end]); err != nil {
+		return errors.Wrap(err, "failed to write raw header")
+	}
+	return nil
+}
+
+// writeTableGap writes unused part of the table which starts at base, has
+// entries of n bytes each and ends at end. Entries which were used by frames
+// no longer in the sprite are zeroed.
+func (sp *sprite) writeTableGap(w io.Writer, base, n, end int) error {
+	start := base + n*int(sp.frameCount)
+	if stale := base + n*int(sp.rawFrameCount); stale > start {
+		if stale > end {
+			stale = end
+		}
+		if err := advanceWriter(w, stale-start); err != nil {
+			return err
+		}
+		start = stale
+	}
+	return sp.writeRawHeader(w, start, end)
+}
+
+// checkSprite checks whether sp's header fields are consistent with each
+// other.
+func checkSprite(sp Sprite) error {
+	if sp.FrameCount() > maxFrameCount {
+		return errors.Errorf("too many frames; expected at most %d, got %d", maxFrameCount, sp.FrameCount())
+	}
+	if w, h := sp.FrameWidth()*sp.FrameCount(), sp.FrameHeight(); sp.Width() != w || sp.Height() != h {
+		return errors.Errorf("mismatched sprite size; expected %dx%d, got %dx%d", w, h, sp.Width(), sp.Height())
+	}
+	prev := int64(0)
+	for i := 0; i < sp.FrameCount(); i++ {
+		o, err := sp.frameOffset(i)
+		if err != nil {
+			return err
+		}
+		if o < prev {
+			return errors.Errorf("frame #%d's offset %d precedes previous frame's offset %d", i, o, prev)
+		}
+		prev = o
+	}
+	return nil
+}
+
+// checkFrameData checks whether size bytes of encoded data can possibly hold
+// a frame of sp, so that frame size in a malformed header can't make decoders
+// allocate huge images for tiny data.
+func checkFrameData(sp Sprite, idx, size int) error {
+	// Every encoded run takes at least 2 bytes and has at most 255 pixels.
+	if n := uint64(sp.FrameWidth()) * uint64(sp.FrameHeight()); n > uint64(size)*128 {
+		err := errors.Wrapf(ErrTruncated, "%d bytes of data can't hold %dx%d pixels", size, sp.FrameWidth(), sp.FrameHeight())
+		return &FormatError{sp.Kind(), idx, -1, -1, -1, err}
+	}
+	return nil
+}
+
+func checkFrameImage(img image.Image, frameWidth, frameHeight int) error {
+	if img == nil {
+		return errors.New("frame image is empty")
+	}
+	if b := img.Bounds(); b.Dx() != frameWidth || b.Dy() != frameHeight {
+		return errors.Errorf("mismatched frame size; expected %dx%d, got %dx%d", frameWidth, frameHeight, b.Dx(), b.Dy())
+	}
+	return nil
+}
+
 type spriteHeader struct {
 	Signature, FrameWidth, FrameHeight, FrameCount uint32
 }
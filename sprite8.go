@@ -1,10 +1,8 @@
 package gosang
 
 import (
-	"bufio"
-	"encoding/binary"
 	"image"
-	"io"
+	"image/color"
 
 	"github.com/pkg/errors"
 )
@@ -12,70 +10,82 @@ import (
 // sprite8 is an 8-bit color sprite.
 type sprite8 struct {
 	sprite
+	palette color.Palette
 }
 
-func newSprite8(r io.ReaderAt, header spriteHeader) (*sprite8, error) {
-	sp := &sprite8{sprite{
-		r:           r,
-		frameWidth:  header.FrameWidth,
-		frameHeight: header.FrameHeight,
-		frameCount:  header.FrameCount,
-		offsets:     make([]uint32, header.FrameCount),
-		frames:      make([]*Frame, header.FrameCount),
-	}}
-	if err := binary.Read(&offsetedReader{r, 0x4c0}, binary.LittleEndian, &sp.offsets); err != nil {
-		return nil, errors.Wrap(err, "failed to read frame offsets")
-	}
-	if err := binary.Read(&offsetedReader{r, 0xbcc}, binary.LittleEndian, &sp.width); err != nil {
-		return nil, errors.Wrap(err, "failed to read sprite width")
-	}
-	if err := binary.Read(&offsetedReader{r, 0xbd0}, binary.LittleEndian, &sp.height); err != nil {
-		return nil, errors.Wrap(err, "failed to read sprite height")
-	}
-	return sp, nil
-}
-
-func (sp *sprite8) ColorBits() int {
-	return 8
+func (sp *sprite8) Kind() Kind {
+	return Kind8
 }
 
-func (sp *sprite8) HasAlpha() bool {
-	return false
+func (sp *sprite8) Palette() color.Palette {
+	return sp.palette
 }
 
-func (sp *sprite8) Save(w io.Writer) error {
-	return nil
+func (sp *sprite8) decodeFrame(data []byte) (image.Image, error) {
+	width, height := int(sp.frameWidth), int(sp.frameHeight)
+	img := image.NewPaletted(image.Rect(0, 0, width, height), sp.palette)
+	pos := 0
+	for y := 0; y < height; y++ {
+		pix := img.Pix[y*img.Stride : y*img.Stride+width]
+		for x := 0; x < width; {
+			if pos >= len(data) {
+				return img, newFormatError(sp.Kind(), y, x, int64(len(data)), ErrTruncated)
+			}
+			b := data[pos]
+			if b != 0xfe {
+				pix[x] = b
+				pos++
+				x++
+				continue
+			}
+			if pos+1 >= len(data) {
+				return img, newFormatError(sp.Kind(), y, x, int64(len(data)), ErrTruncated)
+			}
+			c := int(data[pos+1])
+			if x+c > width {
+				return img, newFormatError(sp.Kind(), y, x, int64(pos), errors.Wrapf(ErrRowOverflow, "run of %d pixels", c))
+			}
+			for end := x + c; x < end; x++ {
+				pix[x] = b
+			}
+			pos += 2
+		}
+	}
+	return img, nil
 }
 
-func (sp *sprite8) loadFrame(idx int) (*Frame, error) {
-	if idx < 0 || idx > int(sp.frameCount-1) {
-		return nil, errors.New("frame index out of range")
+func (sp *sprite8) encodeFrame(dst []byte, idx int) ([]byte, error) {
+	if idx < 0 || idx >= int(sp.frameCount) {
+		return dst, ErrFrameOutOfRange
 	}
-	if sp.frames[idx] == nil {
-		img := image.NewPaletted(image.Rect(0, 0, int(sp.frameWidth), int(sp.frameHeight)), sprite8Palette)
-		r := bufio.NewReader(&offsetedReader{sp.r, 0xbf4 + int64(sp.offsets[idx])})
-		for y := uint32(0); y < sp.frameHeight; y++ {
-			for x := uint32(0); x < sp.frameWidth; {
-				b, err := r.ReadByte()
-				if err != nil {
-					return nil, errors.Wrap(err, "failed to read frame data")
-				}
-				if b == 0xfe {
-					c, err := r.ReadByte()
-					if err != nil {
-						return nil, errors.Wrap(err, "failed to read frame data")
-					}
-					for ; c > 0; c-- {
-						img.SetColorIndex(int(x), int(y), b)
-						x++
-					}
-				} else {
-					img.SetColorIndex(int(x), int(y), b)
-					x++
-				}
+	img := sp.frames[idx].img
+	if img == nil {
+		return dst, errors.Errorf("frame #%d's image is empty", idx)
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return dst, errors.Errorf("invalid image bounds: %v", b)
+	}
+	width, height := b.Dx(), b.Dy()
+	if uint32(width) != sp.frameWidth || uint32(height) != sp.frameHeight {
+		return dst, errors.New("mismatched frame size")
+	}
+	rows := newIndexRows(img, sp.palette)
+	for y := 0; y < height; y++ {
+		row := rows.row(y)
+		for x := 0; x < width; {
+			if row[x] != 0xfe {
+				dst = append(dst, row[x])
+				x++
+				continue
+			}
+			c := uint8(0)
+			for x < width && c < 0xff && row[x] == 0xfe {
+				c++
+				x++
 			}
+			dst = append(dst, 0xfe, c)
 		}
-		sp.frames[idx] = newFrame(sp, idx, img)
 	}
-	return sp.frames[idx], nil
+	return dst, nil
 }
@@ -2,14 +2,24 @@ package gosang
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 )
 
 func TestOpenSprite(t *testing.T) {
 	for _, tc := range []struct {
 		name        string
+		kind        Kind
 		colorBits   int
 		frameWidth  int
 		frameHeight int
@@ -17,9 +27,9 @@ func TestOpenSprite(t *testing.T) {
 		width       int
 		height      int
 	}{
-		{"arrow.spr", 8, 20, 20, 10, 200, 20},
-		{"BUTTMENU_ONLINE_1.S32", 32, 24, 52, 2, 48, 52},
-		{"WindCutter.S32", 32, 640, 480, 15, 9600, 480},
+		{"arrow.spr", Kind8, 8, 20, 20, 10, 200, 20},
+		{"BUTTMENU_ONLINE_1.S32", Kind32, 32, 24, 52, 2, 48, 52},
+		{"WindCutter.S32", Kind32Alpha, 32, 640, 480, 15, 9600, 480},
 	} {
 		func() {
 			f, err := os.Open(filepath.Join("test", "data", tc.name))
@@ -31,6 +41,9 @@ func TestOpenSprite(t *testing.T) {
 			if err != nil {
 				t.Fatalf("sprite %q: failed to open sprite: %v", tc.name, err)
 			}
+			if k := sp.Kind(); k != tc.kind {
+				t.Errorf("sprite %q: bad kind; expected %v, got %v", tc.name, tc.kind, k)
+			}
 			if cb := sp.ColorBits(); cb != tc.colorBits {
 				t.Errorf("sprite %q: bad color bits; expected %d, got %d", tc.name, tc.colorBits, cb)
 			}
@@ -106,7 +119,108 @@ func TestGetFrame(t *testing.T) {
 }
 
 func TestSaveSprite(t *testing.T) {
-	f, err := os.Open(filepath.Join("test", "data", "WindCutter.S32"))
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32", "WindCutter.S32"} {
+		data, err := ioutil.ReadFile(filepath.Join("test", "data", name))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to read file: %v", name, err)
+		}
+		sp, err := OpenSprite(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to open sprite: %v", name, err)
+		}
+		// Frames are encoded in parallel, so output must not depend on how
+		// many of them are encoded at once.
+		for _, procs := range []int{1, 4} {
+			prev := runtime.GOMAXPROCS(procs)
+			b := new(bytes.Buffer)
+			err := sp.Save(b)
+			runtime.GOMAXPROCS(prev)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to save sprite: %v", name, err)
+			}
+			if len(data) != b.Len() {
+				t.Fatalf("sprite %q: data size mismatched; expected %d, got %d", name, len(data), b.Len())
+			}
+			if !bytes.Equal(data, b.Bytes()) {
+				t.Errorf("sprite %q: saved data differs from original with GOMAXPROCS=%d", name, procs)
+			}
+		}
+	}
+}
+
+func TestSavePreservesUnknownRegions(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "BUTTMENU_ONLINE_1.S32"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	for _, off := range []int{0x10, 0x200, 0x4c0 + 4*2, 0x970 + 4*2, 0xe30, 0xe4b} {
+		data[off] = 0xaa
+	}
+	sp, err := OpenSprite(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	b := new(bytes.Buffer)
+	if err := sp.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	if !bytes.Equal(data, b.Bytes()) {
+		t.Errorf("saved data differs from original")
+	}
+}
+
+func TestNewSprite(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		kind Kind
+	}{
+		{"arrow.spr", Kind8},
+		{"BUTTMENU_ONLINE_1.S32", Kind32},
+	} {
+		func() {
+			f, err := os.Open(filepath.Join("test", "data", tc.name))
+			if err != nil {
+				t.Fatalf("sprite %q: failed to open file: %v", tc.name, err)
+			}
+			defer f.Close()
+			sp, err := OpenSprite(f)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to open sprite: %v", tc.name, err)
+			}
+			var frames []image.Image
+			for i := 0; i < sp.FrameCount(); i++ {
+				fr, err := sp.Frame(i)
+				if err != nil {
+					t.Fatalf("sprite %q: failed to get frame #%d: %v", tc.name, i, err)
+				}
+				frames = append(frames, fr.Image())
+			}
+			nsp, err := NewSprite(tc.kind, sp.FrameWidth(), sp.FrameHeight(), frames)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to create sprite: %v", tc.name, err)
+			}
+			if w, h := nsp.Width(), nsp.Height(); w != sp.Width() || h != sp.Height() {
+				t.Errorf("sprite %q: bad size; expected %dx%d, got %dx%d", tc.name, sp.Width(), sp.Height(), w, h)
+			}
+			b1, b2 := new(bytes.Buffer), new(bytes.Buffer)
+			if err := sp.Save(b1); err != nil {
+				t.Fatalf("sprite %q: failed to save original sprite: %v", tc.name, err)
+			}
+			if err := nsp.Save(b2); err != nil {
+				t.Fatalf("sprite %q: failed to save new sprite: %v", tc.name, err)
+			}
+			if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+				t.Errorf("sprite %q: saved data differs", tc.name)
+			}
+		}()
+	}
+	if _, err := NewSprite(Kind32, 2, 2, []image.Image{image.NewNRGBA(image.Rect(0, 0, 3, 2))}); err == nil {
+		t.Errorf("expected error for mismatched frame size")
+	}
+}
+
+func TestEditFrames(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "BUTTMENU_ONLINE_1.S32"))
 	if err != nil {
 		t.Fatalf("failed to open file: %v", err)
 	}
@@ -115,9 +229,83 @@ func TestSaveSprite(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open sprite: %v", err)
 	}
+	fr0, _ := sp.Frame(0)
+	fr1, _ := sp.Frame(1)
+	img0, img1 := fr0.Image(), fr1.Image()
+	if err := sp.SetFrame(0, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err == nil {
+		t.Errorf("expected error for mismatched frame size")
+	}
+	if err := sp.AppendFrame(img0); err != nil {
+		t.Fatalf("failed to append frame: %v", err)
+	}
+	if err := sp.InsertFrame(0, img1); err != nil {
+		t.Fatalf("failed to insert frame: %v", err)
+	}
+	if err := sp.DeleteFrame(1); err != nil {
+		t.Fatalf("failed to delete frame: %v", err)
+	}
+	if err := sp.SetFrame(1, img0); err != nil {
+		t.Fatalf("failed to set frame: %v", err)
+	}
+	if c := sp.FrameCount(); c != 3 {
+		t.Fatalf("bad frame count; expected %d, got %d", 3, c)
+	}
+	if w := sp.Width(); w != 3*sp.FrameWidth() {
+		t.Errorf("bad width; expected %d, got %d", 3*sp.FrameWidth(), w)
+	}
+	for i, img := range []image.Image{img1, img0, img0} {
+		fr, err := sp.Frame(i)
+		if err != nil {
+			t.Fatalf("failed to get frame #%d: %v", i, err)
+		}
+		if fr.Index() != i {
+			t.Errorf("frame #%d has wrong index %d", i, fr.Index())
+		}
+		if fr.Image() != img {
+			t.Errorf("frame #%d has wrong image", i)
+		}
+	}
 	b := new(bytes.Buffer)
 	if err := sp.Save(b); err != nil {
-		t.Fatal(err)
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	nsp, err := OpenSprite(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to reopen sprite: %v", err)
+	}
+	if c := nsp.FrameCount(); c != 3 {
+		t.Errorf("bad frame count after save; expected %d, got %d", 3, c)
+	}
+}
+
+func TestOpenSpriteLazy(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "WindCutter.S32"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	sp, err := OpenSpriteLazy(f)
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	// Lazy open must not read any frame data.
+	header := io.NewSectionReader(f, 0, sp.dataOffset())
+	if _, err := OpenSpriteLazy(header); err != nil {
+		t.Errorf("failed to open sprite lazily w/o frame data: %v", err)
+	}
+	if _, err := OpenSprite(header); err == nil {
+		t.Errorf("expected error for opening sprite w/o frame data")
+	}
+	fr, err := sp.Frame(3)
+	if err != nil {
+		t.Fatalf("failed to get frame #%d: %v", 3, err)
+	}
+	if fr2, _ := sp.Frame(3); fr2 != fr {
+		t.Errorf("frame #%d is not cached", 3)
+	}
+	b := new(bytes.Buffer)
+	if err := sp.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
 	}
 	fi, err := f.Stat()
 	if err != nil {
@@ -127,3 +315,912 @@ func TestSaveSprite(t *testing.T) {
 		t.Fatalf("data size mismatched; expected %d, got %d", fi.Size(), b.Len())
 	}
 }
+
+func TestOpenSpriteOptions(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "arrow.spr"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	if _, err := OpenSprite(f, MaxPixels(20*20*10-1)); err == nil {
+		t.Errorf("expected error for exceeding pixel budget")
+	}
+	if _, err := OpenSprite(f, Strict(), MaxPixels(20*20*10)); err != nil {
+		t.Errorf("failed to open sprite: %v", err)
+	}
+	for _, tc := range []struct {
+		opts  []Option
+		alpha uint32
+	}{
+		{nil, 0},
+		{[]Option{Transparency(TransparentBackground)}, 0},
+		{[]Option{Transparency(KeepBackground)}, 0xffff},
+	} {
+		sp, err := OpenSprite(f, tc.opts...)
+		if err != nil {
+			t.Fatalf("failed to open sprite: %v", err)
+		}
+		fr, err := sp.Frame(0)
+		if err != nil {
+			t.Fatalf("failed to get frame #%d: %v", 0, err)
+		}
+		if _, _, _, a := fr.Image().At(0, 0).RGBA(); a != tc.alpha {
+			t.Errorf("bad background pixel alpha; expected %#x, got %#x", tc.alpha, a)
+		}
+	}
+}
+
+func TestConcurrentFrames(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "WindCutter.S32"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	serial, err := OpenSprite(bytes.NewReader(data), Workers(1))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	sp, err := OpenSprite(bytes.NewReader(data), Lazy())
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	raw, err := serial.RawFrame(0)
+	if err != nil {
+		t.Fatalf("failed to get raw frame #%d: %v", 0, err)
+	}
+	n := sp.FrameCount()
+	errs := make(chan error, 8*n)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				idx := (i + g) % n
+				fr, err := sp.Frame(idx)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				sfr, _ := serial.Frame(idx)
+				if !reflect.DeepEqual(fr.Image(), sfr.Image()) {
+					errs <- fmt.Errorf("frame #%d differs from serially decoded one", idx)
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 4; i++ {
+			if err := sp.AppendRawFrame(raw); err != nil {
+				errs <- err
+			}
+			if err := sp.DeleteFrame(sp.FrameCount() - 1); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32", "WindCutter.S32"} {
+		func() {
+			data, err := ioutil.ReadFile(filepath.Join("test", "data", name))
+			if err != nil {
+				t.Fatalf("sprite %q: failed to read file: %v", name, err)
+			}
+			sp, err := OpenSprite(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("sprite %q: failed to open sprite: %v", name, err)
+			}
+			d, err := NewDecoder(bytes.NewBuffer(data))
+			if err != nil {
+				t.Fatalf("sprite %q: failed to create decoder: %v", name, err)
+			}
+			for i := 0; ; i++ {
+				fr, err := d.Next()
+				if err == io.EOF {
+					if i != sp.FrameCount() {
+						t.Errorf("sprite %q: bad frame count; expected %d, got %d", name, sp.FrameCount(), i)
+					}
+					break
+				} else if err != nil {
+					t.Fatalf("sprite %q: failed to decode frame #%d: %v", name, i, err)
+				}
+				efr, _ := sp.Frame(i)
+				if !reflect.DeepEqual(fr.Image(), efr.Image()) {
+					t.Errorf("sprite %q: frame #%d differs", name, i)
+				}
+			}
+		}()
+	}
+}
+
+func TestConvert(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "arrow.spr"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	sp, err := OpenSprite(f)
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	asp, err := Convert(sp, Kind32Alpha)
+	if err != nil {
+		t.Fatalf("failed to convert to 32-bit alpha sprite: %v", err)
+	}
+	fr, _ := asp.Frame(0)
+	if _, _, _, a := fr.Image().At(0, 0).RGBA(); a != 0 {
+		t.Errorf("background pixel is not transparent")
+	}
+	csp, err := Convert(asp, Kind32)
+	if err != nil {
+		t.Fatalf("failed to convert to 32-bit sprite: %v", err)
+	}
+	fr, _ = csp.Frame(0)
+	if r, g, b, _ := rgbaAt(fr.Image(), 0, 0); r != 0xfc || g != 0xe0 || b != 0xfc {
+		t.Errorf("background pixel is not color key; got (%#x, %#x, %#x)", r, g, b)
+	}
+	bsp, err := Convert(csp, Kind8)
+	if err != nil {
+		t.Fatalf("failed to convert to 8-bit sprite: %v", err)
+	}
+	b1, b2 := new(bytes.Buffer), new(bytes.Buffer)
+	if err := sp.Save(b1); err != nil {
+		t.Fatalf("failed to save original sprite: %v", err)
+	}
+	if err := bsp.Save(b2); err != nil {
+		t.Fatalf("failed to save converted sprite: %v", err)
+	}
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+		t.Errorf("sprite converted back to 8-bit differs from original")
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 16), 0x80, 0xff})
+		}
+	}
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 0})
+	img.SetNRGBA(1, 0, color.NRGBA{0x34, 0x5f, 0x2c, 0xff})
+	for _, d := range []DitherMode{NoDither, FloydSteinbergDither, OrderedDither} {
+		p := Quantize(img, Dithering(d))
+		if ci := p.ColorIndexAt(0, 0); ci != 0xfe {
+			t.Errorf("dither mode %d: transparent pixel mapped to %#x", d, ci)
+		}
+		for y := 0; y < 16; y++ {
+			for x := 1; x < 64; x++ {
+				if ci := p.ColorIndexAt(x, y); ci == 0xfe {
+					t.Fatalf("dither mode %d: opaque pixel (%d, %d) mapped to background index", d, x, y)
+				}
+			}
+		}
+		if d == NoDither {
+			if ci := p.ColorIndexAt(1, 0); ci != 1 {
+				t.Errorf("exact palette color mapped to %#x", ci)
+			}
+		}
+	}
+}
+
+func TestQuantizeDeepColor(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 3, 1))
+	// Low bytes of 16-bit channels must not affect the result, and neither
+	// does alpha above the threshold.
+	img.SetNRGBA64(0, 0, color.NRGBA64{0x34ff, 0x5f01, 0x2cff, 0xffff})
+	img.SetNRGBA64(1, 0, color.NRGBA64{0x3400, 0x5f00, 0x2c00, 0xc000})
+	img.SetNRGBA64(2, 0, color.NRGBA64{0x3400, 0x5f00, 0x2c00, 0x1000})
+	p := Quantize(img)
+	for x, expected := range []uint8{1, 1, 0xfe} {
+		if ci := p.ColorIndexAt(x, 0); ci != expected {
+			t.Errorf("pixel (%d, 0) mapped to %#x, expected %#x", x, ci, expected)
+		}
+	}
+}
+
+func TestPaletteFormats(t *testing.T) {
+	for _, f := range []PaletteFormat{PaletteJASC, PaletteACT, PaletteGPL, PaletteRaw} {
+		b := new(bytes.Buffer)
+		if err := WritePalette(b, sprite8Palette, f); err != nil {
+			t.Fatalf("format %d: failed to write palette: %v", f, err)
+		}
+		p, err := ReadPalette(b, f)
+		if err != nil {
+			t.Fatalf("format %d: failed to read palette: %v", f, err)
+		}
+		if len(p) != len(sprite8Palette) {
+			t.Fatalf("format %d: bad palette size; expected %d, got %d", f, len(sprite8Palette), len(p))
+		}
+		for i := range p {
+			if !reflect.DeepEqual(color.NRGBAModel.Convert(p[i]), color.NRGBAModel.Convert(sprite8Palette[i])) {
+				t.Errorf("format %d: color #%d differs", f, i)
+			}
+		}
+	}
+}
+
+func TestCustomPalette(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "arrow.spr"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{uint8(i)}
+	}
+	sp, err := OpenSprite(f, Palette(p))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	if len(sp.Palette()) != 256 || sp.Palette()[0x10] != p[0x10] {
+		t.Errorf("sprite doesn't use custom palette")
+	}
+	fr, _ := sp.Frame(0)
+	if pi, ok := fr.Image().(*image.Paletted); !ok || pi.Palette[0x10] != p[0x10] {
+		t.Errorf("frame doesn't use custom palette")
+	}
+}
+
+func TestForeignPalette(t *testing.T) {
+	// A paletted image whose palette has as many colors as the sprite's one
+	// must still be mapped by colors, not by indices.
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{uint8(0xff - i)}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), p)
+	img.SetColorIndex(0, 0, 0)
+	img.SetColorIndex(1, 0, 0xff)
+	sp, err := NewSprite(Kind8, 2, 1, []image.Image{img})
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	b := new(bytes.Buffer)
+	if err := sp.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	nsp, err := OpenSprite(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	fr, err := nsp.Frame(0)
+	if err != nil {
+		t.Fatalf("failed to get frame #%d: %v", 0, err)
+	}
+	for x := 0; x < 2; x++ {
+		c := img.At(x, 0)
+		expected := nsp.Palette()[nsp.Palette().Index(c)]
+		if got := fr.Image().At(x, 0); got != expected {
+			t.Errorf("pixel (%d, 0): %v mapped to %v, expected %v", x, c, got, expected)
+		}
+	}
+}
+
+func TestShortPalette(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "arrow.spr"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	b := new(bytes.Buffer)
+	if err := WritePalette(b, color.Palette{color.Black, color.White}, PaletteGPL); err != nil {
+		t.Fatalf("failed to write palette: %v", err)
+	}
+	p, err := ReadPalette(b, PaletteGPL)
+	if err != nil {
+		t.Fatalf("failed to read palette: %v", err)
+	}
+	sp, err := OpenSprite(f, Palette(p))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	if len(sp.Palette()) != 256 {
+		t.Errorf("bad palette size; expected %d, got %d", 256, len(sp.Palette()))
+	}
+	if _, _, _, a := sp.Palette()[0xfe].RGBA(); a != 0 {
+		t.Errorf("background color is not transparent")
+	}
+	fr, err := sp.Frame(0)
+	if err != nil {
+		t.Fatalf("failed to get frame #%d: %v", 0, err)
+	}
+	img := fr.Image()
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.At(x, y)
+		}
+	}
+}
+
+func TestColorKey(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0x40
+	}
+	img.SetNRGBA(1, 0, color.NRGBA{})
+	img.SetNRGBA(2, 1, color.NRGBA{0x10, 0x20, 0x30, 0xff})
+	sp, err := NewSprite(Kind32, 4, 2, []image.Image{img}, ColorKey(color.NRGBA{0x10, 0x20, 0x30, 0xff}))
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	b := new(bytes.Buffer)
+	if err := sp.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	for _, tc := range []struct {
+		opts        []Option
+		transparent bool
+	}{
+		{[]Option{ColorKey(color.NRGBA{0x10, 0x20, 0x30, 0xff})}, true},
+		{[]Option{ColorKey(color.NRGBA{0x10, 0x20, 0x30, 0xff}), Transparency(KeepBackground)}, false},
+		{nil, false},
+	} {
+		nsp, err := OpenSprite(bytes.NewReader(b.Bytes()), tc.opts...)
+		if err != nil {
+			t.Fatalf("failed to open sprite: %v", err)
+		}
+		fr, _ := nsp.Frame(0)
+		for _, pt := range []image.Point{{1, 0}, {2, 1}} {
+			r, g, b, a := rgbaAt(fr.Image(), pt.X, pt.Y)
+			if r != 0x10 || g != 0x20 || b != 0x30 {
+				t.Errorf("pixel %v is not color key; got (%#x, %#x, %#x)", pt, r, g, b)
+			}
+			if (a == 0) != tc.transparent {
+				t.Errorf("pixel %v has bad alpha %#x", pt, a)
+			}
+		}
+		if _, _, _, a := rgbaAt(fr.Image(), 0, 0); a != 0xff {
+			t.Errorf("opaque pixel has bad alpha %#x", a)
+		}
+	}
+}
+
+func TestDeepColor(t *testing.T) {
+	if o := newOptions([]Option{ColorKey(color.Gray16{0x8000})}); o.colorKey != (color.NRGBA{0x80, 0x80, 0x80, 0xff}) {
+		t.Errorf("bad color key from 16-bit color: %v", o.colorKey)
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA64(0, 0, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xffff})
+	sp, err := NewSprite(Kind32, 1, 1, []image.Image{img})
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	data, err := sp.RawFrame(0)
+	if err != nil {
+		t.Fatalf("failed to encode frame: %v", err)
+	}
+	if expected := []byte{1, 0x9a, 0x56, 0x12}; !bytes.Equal(data, expected) {
+		t.Errorf("bad encoded frame; expected %x, got %x", expected, data)
+	}
+}
+
+func TestRawFrame(t *testing.T) {
+	f, err := os.Open(filepath.Join("test", "data", "WindCutter.S32"))
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	sp, err := OpenSpriteLazy(f)
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	nsp, err := NewSprite(Kind32Alpha, sp.FrameWidth(), sp.FrameHeight(), nil)
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	for i := sp.FrameCount() - 1; i >= 0; i-- {
+		data, err := sp.RawFrame(i)
+		if err != nil {
+			t.Fatalf("failed to get raw frame #%d: %v", i, err)
+		}
+		if s, _ := sp.frameSize(i); s != len(data) {
+			t.Errorf("raw frame #%d has bad size; expected %d, got %d", i, s, len(data))
+		}
+		if err := nsp.AppendRawFrame(data); err != nil {
+			t.Fatalf("failed to append raw frame #%d: %v", i, err)
+		}
+	}
+	for i := 0; i < nsp.FrameCount(); i++ {
+		a, _ := sp.RawFrame(sp.FrameCount() - 1 - i)
+		b, _ := nsp.RawFrame(i)
+		if !bytes.Equal(a, b) {
+			t.Errorf("raw frame #%d differs", i)
+		}
+	}
+	fr, err := nsp.Frame(0)
+	if err != nil {
+		t.Fatalf("failed to decode raw frame: %v", err)
+	}
+	efr, _ := sp.Frame(sp.FrameCount() - 1)
+	if !reflect.DeepEqual(fr.Image(), efr.Image()) {
+		t.Errorf("decoded raw frame differs")
+	}
+	b := new(bytes.Buffer)
+	if err := nsp.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	if _, err := OpenSprite(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatalf("failed to reopen sprite: %v", err)
+	}
+	data, _ := sp.RawFrame(0)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"garbage", []byte{1, 2, 3}},
+		{"truncated", data[:len(data)/2]},
+		{"extra bytes", append(append([]byte(nil), data...), 0, 0, 0, 0)},
+		{"unaligned", append(append([]byte(nil), data...), 0)},
+	} {
+		if err := nsp.AppendRawFrame(tc.data); err == nil {
+			t.Errorf("%s: expected error for invalid raw frame", tc.name)
+		}
+	}
+	small, err := NewSprite(Kind32Alpha, sp.FrameWidth()/2, sp.FrameHeight(), nil)
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	if err := small.AppendRawFrame(data); err == nil {
+		t.Errorf("expected error for raw frame of different frame size")
+	}
+}
+
+func TestRawFrameKeepsEncoding(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), sprite8Palette)
+	img.Pix[0], img.Pix[1] = 0xfe, 0xfe
+	sp, err := NewSprite(Kind8, 2, 1, []image.Image{img})
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	b := new(bytes.Buffer)
+	if err := sp.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	// Store the run as two runs of a pixel, which is valid but differs from
+	// what the encoder writes.
+	frame := []byte{0xfe, 1, 0xfe, 1}
+	data := append(b.Bytes()[:sp.dataOffset()], frame...)
+	data[0x970], data[0x971] = byte(len(frame)), 0
+	data[0xbc8], data[0xbc9], data[0xbca], data[0xbcb] = byte(len(frame)), 0, 0, 0
+	if ps := Validate(bytes.NewReader(data)); ps != nil {
+		t.Fatalf("unexpected problems: %v", ps)
+	}
+	for _, opts := range [][]Option{nil, {Lazy()}} {
+		sp, err := OpenSprite(bytes.NewReader(data), opts...)
+		if err != nil {
+			t.Fatalf("failed to open sprite: %v", err)
+		}
+		raw, err := sp.RawFrame(0)
+		if err != nil {
+			t.Fatalf("failed to get raw frame #%d: %v", 0, err)
+		}
+		if !bytes.Equal(raw, frame) {
+			t.Errorf("bad raw frame; expected %x, got %x", frame, raw)
+		}
+		b := new(bytes.Buffer)
+		if err := sp.Save(b); err != nil {
+			t.Fatalf("failed to save sprite: %v", err)
+		}
+		if !bytes.Equal(b.Bytes(), data) {
+			t.Errorf("saved data differs from original")
+		}
+	}
+}
+
+// genericImage hides concrete type of an image, so that encoders take their
+// generic path.
+type genericImage struct{ image.Image }
+
+func TestEncodeFastPaths(t *testing.T) {
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32", "WindCutter.S32"} {
+		data, err := ioutil.ReadFile(filepath.Join("test", "data", name))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to read file: %v", name, err)
+		}
+		sp, err := OpenSprite(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to open sprite: %v", name, err)
+		}
+		fr, err := sp.Frame(0)
+		if err != nil {
+			t.Fatalf("sprite %q: failed to get frame: %v", name, err)
+		}
+		src := fr.Image()
+		b := src.Bounds()
+		rgba := image.NewRGBA(b)
+		nrgba := image.NewNRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				rgba.Set(x, y, src.At(x, y))
+				nrgba.Set(x, y, src.At(x, y))
+			}
+		}
+		// Sub-images have bounds which don't start at the origin.
+		sub := image.NewNRGBA(b.Add(image.Pt(3, 5))).SubImage(b.Add(image.Pt(3, 5))).(*image.NRGBA)
+		copy(sub.Pix, nrgba.Pix)
+		for _, img := range []image.Image{src, rgba, nrgba, sub} {
+			if err := sp.SetFrame(0, img); err != nil {
+				t.Fatalf("sprite %q: failed to set frame: %v", name, err)
+			}
+			fast, err := sp.RawFrame(0)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to encode %T: %v", name, img, err)
+			}
+			if err := sp.SetFrame(0, genericImage{img}); err != nil {
+				t.Fatalf("sprite %q: failed to set frame: %v", name, err)
+			}
+			generic, err := sp.RawFrame(0)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to encode %T: %v", name, img, err)
+			}
+			if !bytes.Equal(fast, generic) {
+				t.Errorf("sprite %q: encoded %T differs from generic path", name, img)
+			}
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32", "WindCutter.S32"} {
+		data, err := ioutil.ReadFile(filepath.Join("test", "data", name))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to read file: %v", name, err)
+		}
+		sp, err := OpenSprite(bytes.NewReader(data), Lazy())
+		if err != nil {
+			t.Fatalf("sprite %q: failed to open sprite: %v", name, err)
+		}
+		// Frame data isn't needed, so probing only header must work.
+		info, err := Probe(bytes.NewReader(data[:sp.dataOffset()]))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to probe sprite: %v", name, err)
+		}
+		expected := Info{
+			Kind:        sp.Kind(),
+			FrameWidth:  sp.FrameWidth(),
+			FrameHeight: sp.FrameHeight(),
+			FrameCount:  sp.FrameCount(),
+			Width:       sp.Width(),
+			Height:      sp.Height(),
+			DataSize:    int64(len(data)) - sp.dataOffset(),
+		}
+		for i := 0; i < sp.FrameCount(); i++ {
+			raw, err := sp.RawFrame(i)
+			if err != nil {
+				t.Fatalf("sprite %q: failed to get raw frame #%d: %v", name, i, err)
+			}
+			expected.FrameSizes = append(expected.FrameSizes, len(raw))
+		}
+		if !reflect.DeepEqual(info, expected) {
+			t.Errorf("sprite %q: bad info; expected %+v, got %+v", name, expected, info)
+		}
+	}
+}
+
+func TestLastFrameSize(t *testing.T) {
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32"} {
+		f, err := os.Open(filepath.Join("test", "data", name))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to open file: %v", name, err)
+		}
+		defer f.Close()
+		sp, err := OpenSprite(f, Lazy())
+		if err != nil {
+			t.Fatalf("sprite %q: failed to open sprite: %v", name, err)
+		}
+		// Last frame's size comes from the frame data size field, so it must
+		// agree with the frame size table.
+		l, last := sp.base().layout(), sp.FrameCount()-1
+		sizes, err := l.readSizeTable(f, sp.Kind(), sp.FrameCount())
+		if err != nil {
+			t.Fatalf("sprite %q: failed to read frame size table: %v", name, err)
+		}
+		expected := int(sizes[last]) * l.sizeUnit
+		size, err := sp.frameSize(last)
+		if err != nil {
+			t.Fatalf("sprite %q: failed to get size of last frame: %v", name, err)
+		}
+		if size != expected {
+			t.Errorf("sprite %q: bad size of last frame; expected %d, got %d", name, expected, size)
+		}
+	}
+}
+
+func TestKind(t *testing.T) {
+	for _, tc := range []struct {
+		kind      Kind
+		name      string
+		signature uint32
+	}{
+		{Kind8, "8-bit", Signature8},
+		{Kind32, "32-bit", Signature32},
+		{Kind32Alpha, "32-bit alpha", Signature32Alpha},
+	} {
+		if s := tc.kind.String(); s != tc.name {
+			t.Errorf("kind %d: bad name; expected %q, got %q", tc.kind, tc.name, s)
+		}
+		if sig := tc.kind.Signature(); sig != tc.signature {
+			t.Errorf("kind %v: bad signature; expected %#x, got %#x", tc.kind, tc.signature, sig)
+		}
+		if k, ok := KindOf(tc.signature); !ok || k != tc.kind {
+			t.Errorf("signature %#x: bad kind; expected %v, got %v", tc.signature, tc.kind, k)
+		}
+	}
+	if _, ok := KindOf(0x1234); ok {
+		t.Errorf("unknown signature has kind")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "BUTTMENU_ONLINE_1.S32"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	_, err = OpenSprite(bytes.NewReader(data[:len(data)-10]))
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	var fe *FormatError
+	if !errors.As(err, &fe) {
+		t.Fatalf("expected FormatError, got %v", err)
+	}
+	if fe.Kind != Kind32 || fe.Frame != 1 || fe.Row != 51 || fe.Offset != int64(len(data)-10) {
+		t.Errorf("bad error location: %v", fe)
+	}
+	bad := append([]byte{0x12}, data[1:]...)
+	if _, err := OpenSprite(bytes.NewReader(bad)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+	sp, err := OpenSprite(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	if _, err := sp.Frame(2); !errors.Is(err, ErrFrameOutOfRange) {
+		t.Errorf("expected ErrFrameOutOfRange, got %v", err)
+	}
+}
+
+func TestHostileInput(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "BUTTMENU_ONLINE_1.S32"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	put := func(b []byte, offset int, v uint32) {
+		b[offset], b[offset+1], b[offset+2], b[offset+3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(b []byte)
+		target error
+	}{
+		{"overflowing run", func(b []byte) { b[0xe4c] = 0xff }, ErrRowOverflow},
+		{"too many frames", func(b []byte) { put(b, 12, 0xffffffff) }, nil},
+		{"huge frames", func(b []byte) { put(b, 4, 0x10000); put(b, 8, 0x10000) }, ErrTruncated},
+		{"bad data size", func(b []byte) { put(b, 0xe20, 0) }, nil},
+		{"zero frame width", func(b []byte) { put(b, 4, 0); put(b, 8, 0x7fffffff) }, nil},
+		{"zero frame height", func(b []byte) { put(b, 4, 0x7fffffff); put(b, 8, 0) }, nil},
+	} {
+		b := append([]byte(nil), data...)
+		tc.modify(b)
+		_, err := OpenSprite(bytes.NewReader(b))
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		} else if tc.target != nil && !errors.Is(err, tc.target) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.target, err)
+		}
+	}
+	// Frame size which the header claims must not be allocated before the
+	// data is actually read.
+	b := append([]byte(nil), data[:0xe4c+100]...)
+	put(b, 4, 30000)
+	put(b, 8, 30000)
+	put(b, 12, 1)
+	put(b, 0xe20, 0xffffffff)
+	for _, tc := range []struct {
+		name string
+		open func(r *bytes.Reader) error
+	}{
+		{"stream", func(r *bytes.Reader) error { _, err := DecodeSprite(r); return err }},
+		{"open", func(r *bytes.Reader) error { _, err := OpenSprite(r); return err }},
+		{"salvage", func(r *bytes.Reader) error { _, _, err := Salvage(r); return err }},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := tc.open(bytes.NewReader(b))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("huge frames by %s: expected error", tc.name)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+			t.Errorf("huge frames by %s: %d bytes allocated", tc.name, n)
+		}
+	}
+	b = append([]byte(nil), data...)
+	put(b, 12, 0)
+	sp, err := OpenSprite(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to open sprite without frames: %v", err)
+	}
+	if _, err := sp.Frame(0); !errors.Is(err, ErrFrameOutOfRange) {
+		t.Errorf("expected ErrFrameOutOfRange, got %v", err)
+	}
+	b = append([]byte(nil), data...)
+	put(b, 0x4c4, 0xffffffff)
+	sp, err = OpenSprite(bytes.NewReader(b), Lazy())
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	if _, err := sp.RawFrame(1); err == nil {
+		t.Errorf("expected error for raw frame at bad offset")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, name := range []string{"arrow.spr", "BUTTMENU_ONLINE_1.S32", "WindCutter.S32"} {
+		data, err := ioutil.ReadFile(filepath.Join("test", "data", name))
+		if err != nil {
+			t.Fatalf("sprite %q: failed to read file: %v", name, err)
+		}
+		if ps := Validate(bytes.NewReader(data)); ps != nil {
+			t.Errorf("sprite %q: unexpected problems: %v", name, ps)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "BUTTMENU_ONLINE_1.S32"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	for _, tc := range []struct {
+		name  string
+		patch func(b []byte)
+		frame int
+	}{
+		{"bad width", func(b []byte) { b[0xe24]++ }, -1},
+		{"bad size table", func(b []byte) { b[0x970]++ }, 0},
+		{"overflowing run", func(b []byte) { b[0xe4c] = 0xff }, 0},
+		{"truncated", func(b []byte) { b[0xe20] += 4 }, 1},
+	} {
+		b := append([]byte(nil), data...)
+		tc.patch(b)
+		ps := Validate(bytes.NewReader(b))
+		if len(ps) == 0 {
+			t.Errorf("%s: no problem found", tc.name)
+			continue
+		}
+		found := false
+		for _, p := range ps {
+			found = found || p.Frame == tc.frame
+		}
+		if !found {
+			t.Errorf("%s: no problem found for frame %d; got %v", tc.name, tc.frame, ps)
+		}
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "BUTTMENU_ONLINE_1.S32"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	orig, err := OpenSprite(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to open sprite: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		data     func() []byte
+		intact   []int // Frames which must be fully recovered.
+		problems bool
+	}{
+		{"intact", func() []byte { return data }, []int{0, 1}, false},
+		{"truncated", func() []byte { return data[:len(data)-10] }, []int{0}, true},
+		{"corrupt offsets", func() []byte {
+			b := append([]byte(nil), data...)
+			b[0x4c4], b[0x4c5], b[0x4c6], b[0x4c7] = 0xef, 0xbe, 0xad, 0xde
+			return b
+		}, []int{0, 1}, true},
+	} {
+		sp, ps, err := Salvage(bytes.NewReader(tc.data()))
+		if err != nil {
+			t.Fatalf("%s: failed to salvage sprite: %v", tc.name, err)
+		}
+		if (ps != nil) != tc.problems {
+			t.Errorf("%s: unexpected problems: %v", tc.name, ps)
+		}
+		if sp.FrameCount() != orig.FrameCount() {
+			t.Fatalf("%s: bad frame count; expected %d, got %d", tc.name, orig.FrameCount(), sp.FrameCount())
+		}
+		for _, i := range tc.intact {
+			fr, err := sp.Frame(i)
+			if err != nil {
+				t.Fatalf("%s: failed to get frame #%d: %v", tc.name, i, err)
+			}
+			ofr, _ := orig.Frame(i)
+			if !reflect.DeepEqual(fr.Image(), ofr.Image()) {
+				t.Errorf("%s: frame #%d is not recovered", tc.name, i)
+			}
+		}
+		buf := new(bytes.Buffer)
+		if err := sp.Save(buf); err != nil {
+			t.Fatalf("%s: failed to save sprite: %v", tc.name, err)
+		}
+		if ps := Validate(bytes.NewReader(buf.Bytes())); ps != nil {
+			t.Errorf("%s: saved sprite has problems: %v", tc.name, ps)
+		}
+	}
+	empty, err := NewSprite(Kind32, 2, 2, nil)
+	if err != nil {
+		t.Fatalf("failed to create sprite: %v", err)
+	}
+	b := new(bytes.Buffer)
+	if err := empty.Save(b); err != nil {
+		t.Fatalf("failed to save sprite: %v", err)
+	}
+	if _, ps, err := Salvage(bytes.NewReader(b.Bytes())); err != nil || ps != nil {
+		t.Errorf("failed to salvage sprite w/o frames: %v, %v", err, ps)
+	}
+}
+
+func benchmarkOpenSprite(b *testing.B, opts ...Option) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "WindCutter.S32"))
+	if err != nil {
+		b.Fatalf("failed to read file: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := OpenSprite(bytes.NewReader(data), opts...); err != nil {
+			b.Fatalf("failed to open sprite: %v", err)
+		}
+	}
+}
+
+func BenchmarkOpenSprite(b *testing.B) {
+	benchmarkOpenSprite(b)
+}
+
+func BenchmarkOpenSpriteSerial(b *testing.B) {
+	benchmarkOpenSprite(b, Workers(1))
+}
+
+func BenchmarkDecodeSprite(b *testing.B) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "WindCutter.S32"))
+	if err != nil {
+		b.Fatalf("failed to read file: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeSprite(bytes.NewReader(data)); err != nil {
+			b.Fatalf("failed to decode sprite: %v", err)
+		}
+	}
+}
+
+func BenchmarkSaveSprite(b *testing.B) {
+	data, err := ioutil.ReadFile(filepath.Join("test", "data", "WindCutter.S32"))
+	if err != nil {
+		b.Fatalf("failed to read file: %v", err)
+	}
+	sp, err := OpenSprite(bytes.NewReader(data))
+	if err != nil {
+		b.Fatalf("failed to open sprite: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sp.Save(ioutil.Discard); err != nil {
+			b.Fatalf("failed to save sprite: %v", err)
+		}
+	}
+}
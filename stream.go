@@ -0,0 +1,163 @@
+package gosang
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// maxHeaderSize is the size of the largest header among all kinds of
+// sprites, including offset tables.
+var maxHeaderSize = largestHeaderSize()
+
+func largestHeaderSize() int64 {
+	n := int64(0)
+	for _, ki := range kinds {
+		if ki.layout.data > n {
+			n = ki.layout.data
+		}
+	}
+	return n
+}
+
+// Decoder decodes sprite from a stream in single forward pass. Unlike
+// OpenSprite, it doesn't need io.ReaderAt, so it can read sprites from pipes,
+// network connections or compressed streams. Frames are decoded in order,
+// one by one, and are not kept by the decoder.
+type Decoder struct {
+	r   *countingReader
+	sp  Sprite
+	idx int
+}
+
+// NewDecoder reads sprite's header from r and returns a decoder for its
+// frames. Options which don't make sense for streams, like Lazy, are ignored.
+func NewDecoder(r io.Reader, opts ...Option) (*Decoder, error) {
+	o := newOptions(opts)
+	buf := make([]byte, maxHeaderSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+	buf = buf[:n]
+	var header spriteHeader
+	if err := readField(bytes.NewReader(buf), 0, 0, &header); err != nil {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+	sp, err := newSprite(bytes.NewReader(buf), header, o)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) < sp.dataOffset() {
+		return nil, errors.Wrap(newFormatError(sp.Kind(), -1, -1, int64(n), ErrTruncated), "failed to read header")
+	}
+	rest := io.MultiReader(bytes.NewReader(buf[sp.dataOffset():]), r)
+	return &Decoder{r: &countingReader{r: rest}, sp: sp}, nil
+}
+
+// Sprite returns the sprite being decoded. Its frames are not available
+// through Sprite.Frame; use Next instead.
+func (d *Decoder) Sprite() Sprite {
+	return d.sp
+}
+
+// Next decodes next frame. It returns io.EOF when there are no more frames.
+func (d *Decoder) Next() (*Frame, error) {
+	if d.idx >= d.sp.FrameCount() {
+		return nil, io.EOF
+	}
+	offset, err := d.sp.frameOffset(d.idx)
+	if err != nil {
+		return nil, err
+	}
+	if offset < d.r.n {
+		return nil, errors.Errorf("frame #%d is not stored in order", d.idx)
+	}
+	if _, err := io.CopyN(ioutil.Discard, d.r, offset-d.r.n); err != nil {
+		err = newFormatError(d.sp.Kind(), -1, -1, d.sp.dataOffset()+d.r.n, err)
+		return nil, errors.Wrapf(err, "failed to skip to frame #%d", d.idx)
+	}
+	size, err := d.sp.frameSize(d.idx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFrameData(d.sp, d.idx, size); err != nil {
+		return nil, err
+	}
+	data, err := readFrameData(d.sp, d.r, size)
+	if err != nil {
+		err = newFormatError(d.sp.Kind(), -1, -1, d.sp.dataOffset()+d.r.n, err)
+		return nil, errors.Wrapf(err, "failed to read frame #%d", d.idx)
+	}
+	// Check again with the data actually read, before the frame's image is
+	// allocated.
+	if err := checkFrameData(d.sp, d.idx, len(data)); err != nil {
+		return nil, err
+	}
+	img, err := d.sp.decodeFrame(data)
+	if err != nil {
+		err = locateError(err, d.idx, d.sp.dataOffset()+offset)
+		return nil, errors.Wrapf(err, "failed to decode frame #%d", d.idx)
+	}
+	fr := newFrame(d.sp, d.idx, img)
+	d.idx++
+	return fr, nil
+}
+
+// DecodeSprite reads whole sprite from r and returns it with every frame
+// decoded.
+func DecodeSprite(r io.Reader, opts ...Option) (Sprite, error) {
+	d, err := NewDecoder(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		fr, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := d.sp.SetFrame(fr.Index(), fr.Image()); err != nil {
+			return nil, err
+		}
+	}
+	return d.sp, nil
+}
+
+// Decode reads sprite from r and returns its first frame's image. It has the
+// signature image.RegisterFormat expects, so that sprites can be decoded by
+// image.Decode; see package gosang/register.
+func Decode(r io.Reader) (image.Image, error) {
+	d, err := NewDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := d.Next()
+	if err == io.EOF {
+		return nil, errors.New("sprite has no frame")
+	} else if err != nil {
+		return nil, err
+	}
+	return fr.Image(), nil
+}
+
+// DecodeConfig reads sprite's header from r and returns its frame size and
+// color model, without decoding any frame. Color model of 8-bit sprites is
+// their palette.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d, err := NewDecoder(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	sp := d.Sprite()
+	var m color.Model = color.NRGBAModel
+	if p := sp.Palette(); p != nil {
+		m = p
+	}
+	return image.Config{ColorModel: m, Width: sp.FrameWidth(), Height: sp.FrameHeight()}, nil
+}
@@ -21,6 +21,18 @@ func (or *offsetedReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// countingReader is a reader which counts how many bytes have been read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
 func advanceWriter(w io.Writer, n int) error {
 	b := []byte{0}
 	for n > 0 {
@@ -37,16 +49,146 @@ func advanceWriter(w io.Writer, n int) error {
 }
 
 func rgbaAt(img image.Image, x, y int) (r, g, b, a uint8) {
-	switch p := img.At(x, y).(type) {
+	return rgbaOf(img.At(x, y))
+}
+
+func rgbaOf(c color.Color) (r, g, b, a uint8) {
+	switch p := c.(type) {
 	case color.NRGBA:
 		r, g, b, a = p.R, p.G, p.B, p.A
 	default:
-		tr, tg, tb, ta := p.RGBA()
-		r, g, b, a = uint8(tr), uint8(tg), uint8(tb), uint8(ta)
+		n := color.NRGBAModel.Convert(p).(color.NRGBA)
+		r, g, b, a = n.R, n.G, n.B, n.A
 	}
 	return
 }
 
+// rgbaRows reads rows of an image as 4 bytes per pixel in R, G, B, A order,
+// the same as rgbaOf returns. Rows of *image.NRGBA are their Pix as-is, rows
+// of *image.RGBA only have their translucent pixels converted, and colors of
+// *image.Paletted are looked up in a table, so that frames can be encoded
+// without converting every pixel.
+type rgbaRows struct {
+	img     image.Image
+	palette [256][4]uint8 // Colors of *image.Paletted's palette.
+	buf     []byte
+}
+
+func newRGBARows(img image.Image) *rgbaRows {
+	rr := &rgbaRows{img: img}
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return rr
+	case *image.Paletted:
+		for i, c := range img.Palette {
+			if i == len(rr.palette) {
+				break
+			}
+			r, g, b, a := rgbaOf(c)
+			rr.palette[i] = [4]uint8{r, g, b, a}
+		}
+	}
+	rr.buf = make([]byte, 4*img.Bounds().Dx())
+	return rr
+}
+
+// row returns y-th row of the image, counted from the top of its bounds. The
+// returned slice is valid until next call.
+func (rr *rgbaRows) row(y int) []byte {
+	b := rr.img.Bounds()
+	width := b.Dx()
+	switch img := rr.img.(type) {
+	case *image.NRGBA:
+		i := img.PixOffset(b.Min.X, b.Min.Y+y)
+		return img.Pix[i : i+4*width]
+	case *image.RGBA:
+		i := img.PixOffset(b.Min.X, b.Min.Y+y)
+		copy(rr.buf, img.Pix[i:i+4*width])
+		for x := 0; x < width; x++ {
+			// Colors of *image.RGBA are alpha-premultiplied.
+			if p := rr.buf[4*x : 4*x+4]; p[3] != 0xff {
+				p[0], p[1], p[2], p[3] = rgbaOf(color.RGBA{p[0], p[1], p[2], p[3]})
+			}
+		}
+	case *image.Paletted:
+		i := img.PixOffset(b.Min.X, b.Min.Y+y)
+		for x, ci := range img.Pix[i : i+width] {
+			copy(rr.buf[4*x:], rr.palette[ci][:])
+		}
+	default:
+		for x := 0; x < width; x++ {
+			p := rr.buf[4*x : 4*x+4]
+			p[0], p[1], p[2], p[3] = rgbaAt(img, b.Min.X+x, b.Min.Y+y)
+		}
+	}
+	return rr.buf
+}
+
+// indexRows reads rows of an image as color indices for a palette. Rows of
+// *image.Paletted whose palette is the same are their Pix as-is, colors of
+// other *image.Paletted are mapped once per palette entry, and others are
+// mapped pixel by pixel.
+type indexRows struct {
+	img     image.Image
+	p       color.Palette
+	same    bool       // Whether img is *image.Paletted with the same palette.
+	indices [256]uint8 // Indices of *image.Paletted's palette entries in p.
+	buf     []byte
+}
+
+func newIndexRows(img image.Image, p color.Palette) *indexRows {
+	ir := &indexRows{img: img, p: p}
+	if pi, ok := img.(*image.Paletted); ok {
+		if ir.same = samePalette(pi.Palette, p); ir.same {
+			return ir
+		}
+		for i, c := range pi.Palette {
+			if i == len(ir.indices) {
+				break
+			}
+			ir.indices[i] = uint8(p.Index(c))
+		}
+	}
+	ir.buf = make([]byte, img.Bounds().Dx())
+	return ir
+}
+
+// row returns y-th row of the image, counted from the top of its bounds. The
+// returned slice is valid until next call.
+func (ir *indexRows) row(y int) []byte {
+	b := ir.img.Bounds()
+	if pi, ok := ir.img.(*image.Paletted); ok {
+		i := pi.PixOffset(b.Min.X, b.Min.Y+y)
+		if ir.same {
+			return pi.Pix[i : i+b.Dx()]
+		}
+		for x, ci := range pi.Pix[i : i+b.Dx()] {
+			ir.buf[x] = ir.indices[ci]
+		}
+		return ir.buf
+	}
+	for x := range ir.buf {
+		ir.buf[x] = uint8(ir.p.Index(ir.img.At(b.Min.X+x, b.Min.Y+y)))
+	}
+	return ir.buf
+}
+
+// samePalette tells whether palettes a and b have the same colors in the same
+// order.
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		ar, ag, ab, aa := a[i].RGBA()
+		br, bg, bb, ba := b[i].RGBA()
+		if ar != br || ag != bg || ab != bb || aa != ba {
+			return false
+		}
+	}
+	return true
+}
+
 // sprite8Palette is a color palette used by 8-bit color sprites.
 var sprite8Palette = color.Palette{
 	color.RGBA{0x00, 0x00, 0x00, 0xff},
@@ -0,0 +1,191 @@
+package gosang
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Problem is a structural problem of sprite data found by Validate.
+type Problem struct {
+	Frame   int    // Index of the frame, or -1 if it's not frame specific.
+	Offset  int64  // Offset in sprite data, or -1 if unknown.
+	Message string // Description of the problem.
+}
+
+func (p Problem) String() string {
+	var ss []string
+	if p.Frame >= 0 {
+		ss = append(ss, fmt.Sprintf("frame #%d", p.Frame))
+	}
+	if p.Offset >= 0 {
+		ss = append(ss, fmt.Sprintf("offset %#x", p.Offset))
+	}
+	ss = append(ss, p.Message)
+	return strings.Join(ss, ": ")
+}
+
+// Validate checks structure of sprite data in r without trusting any of it.
+// It checks header tables against each other and makes sure that every
+// frame's rows decode to exactly the frame width. It returns nil if no
+// problem has been found.
+func Validate(r io.ReaderAt) []Problem {
+	var ps []Problem
+	report := func(frame int, offset int64, format string, args ...interface{}) {
+		ps = append(ps, Problem{frame, offset, fmt.Sprintf(format, args...)})
+	}
+	var header spriteHeader
+	if err := readField(r, 0, 0, &header); err != nil {
+		report(-1, 0, "failed to read header: %v", problemCause(err))
+		return ps
+	}
+	kind, ok := KindOf(header.Signature)
+	if !ok {
+		report(-1, 0, "unknown signature %#x", header.Signature)
+		return ps
+	}
+	if header.FrameWidth == 0 || header.FrameHeight == 0 {
+		report(-1, 4, "invalid frame size %dx%d", header.FrameWidth, header.FrameHeight)
+	}
+	if header.FrameCount > maxFrameCount {
+		report(-1, 12, "frame count %d exceeds offset table size %d", header.FrameCount, maxFrameCount)
+		return ps
+	}
+	l := &kinds[kind].layout
+	sizes, err := l.readSizeTable(r, kind, int(header.FrameCount))
+	if err != nil {
+		report(-1, l.sizes, "failed to read frame size table: %v", problemCause(err))
+		return ps
+	}
+	offsets := make([]uint32, header.FrameCount)
+	if err := readField(r, kind, offsetsOffset, offsets); err != nil {
+		report(-1, offsetsOffset, "failed to read frame offset table: %v", problemCause(err))
+		return ps
+	}
+	var total, width, height uint32
+	if err := readField(r, kind, l.dataSize, &total); err != nil {
+		report(-1, l.dataSize, "failed to read frame data size: %v", problemCause(err))
+		return ps
+	}
+	if err := readField(r, kind, l.dataSize+4, &width); err != nil {
+		report(-1, l.dataSize+4, "failed to read sprite width: %v", problemCause(err))
+		return ps
+	}
+	if err := readField(r, kind, l.dataSize+8, &height); err != nil {
+		report(-1, l.dataSize+8, "failed to read sprite height: %v", problemCause(err))
+		return ps
+	}
+	if w := uint64(header.FrameWidth) * uint64(header.FrameCount); uint64(width) != w {
+		report(-1, l.dataSize+4, "sprite width %d doesn't match frame width %d x frame count %d", width, header.FrameWidth, header.FrameCount)
+	}
+	if height != header.FrameHeight {
+		report(-1, l.dataSize+8, "sprite height %d doesn't match frame height %d", height, header.FrameHeight)
+	}
+	if total > 0 {
+		if _, err := r.ReadAt(make([]byte, 1), l.data+int64(total)-1); err != nil {
+			report(-1, l.data, "frame data is shorter than %d bytes", total)
+		}
+	}
+	for i := range offsets {
+		if offsets[i] > total {
+			report(i, offsetsOffset+4*int64(i), "frame offset %d is beyond frame data size %d", offsets[i], total)
+			continue
+		}
+		end := total
+		if i+1 < len(offsets) {
+			if offsets[i+1] < offsets[i] {
+				report(i+1, offsetsOffset+4*int64(i+1), "frame offset %d precedes previous frame's offset %d", offsets[i+1], offsets[i])
+				continue
+			}
+			if offsets[i+1] <= total {
+				end = offsets[i+1]
+			}
+		}
+		size := end - offsets[i]
+		if uint64(sizes[i])*uint64(l.sizeUnit) != uint64(size) {
+			report(i, l.sizes+int64(i*l.sizeEntry), "frame size table says %d bytes, but offsets say %d bytes", uint64(sizes[i])*uint64(l.sizeUnit), size)
+		}
+		if header.FrameWidth == 0 || header.FrameHeight == 0 {
+			continue
+		}
+		start := l.data + int64(offsets[i])
+		br := bufio.NewReader(io.NewSectionReader(r, start, int64(size)))
+		n, err := scanFrame(kind, br, int(header.FrameWidth), int(header.FrameHeight))
+		if err != nil {
+			var fe *FormatError
+			if errors.As(err, &fe) {
+				report(i, start+fe.Offset, "row %d, column %d: %v", fe.Row, fe.Column, fe.Err)
+			} else {
+				report(i, start, "%v", err)
+			}
+		} else if n != int64(size) {
+			report(i, start+n, "frame data has %d extra bytes", int64(size)-n)
+		}
+	}
+	return ps
+}
+
+// problemCause returns the underlying error of err for problem messages,
+// since problems already have their location.
+func problemCause(err error) error {
+	var fe *FormatError
+	if errors.As(err, &fe) {
+		return fe.Err
+	}
+	return err
+}
+
+// scanFrame reads encoded frame data from r and checks that every row has
+// exactly width pixels, without decoding them. It returns the number of
+// bytes the frame's data consists of.
+func scanFrame(kind Kind, r io.ByteReader, width, height int) (int64, error) {
+	n := int64(0)
+	readByte := func() (byte, error) {
+		b, err := r.ReadByte()
+		if err == nil {
+			n++
+		}
+		return b, err
+	}
+	recordSize := 4
+	if kind == Kind8 {
+		recordSize = 1
+	}
+	var rec [4]byte
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; {
+			for i := 0; i < recordSize; i++ {
+				b, err := readByte()
+				if err != nil {
+					return n, newFormatError(kind, y, x, n, err)
+				}
+				rec[i] = b
+			}
+			c := 1
+			switch kind {
+			case Kind8:
+				if rec[0] == 0xfe {
+					b, err := readByte()
+					if err != nil {
+						return n, newFormatError(kind, y, x, n, err)
+					}
+					c = int(b)
+				}
+			case Kind32:
+				c = int(rec[0])
+			case Kind32Alpha:
+				if rec[0] == 0 && rec[2] == 0 && rec[3] == 0 {
+					c = int(rec[1])
+				}
+			}
+			if x+c > width {
+				return n, newFormatError(kind, y, x, n-int64(recordSize), errors.Wrapf(ErrRowOverflow, "run of %d pixels", c))
+			}
+			x += c
+		}
+	}
+	return n, nil
+}